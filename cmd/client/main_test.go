@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Kobiee88/peril/internal/gamelogic"
+	"github.com/Kobiee88/peril/internal/pubsub"
+	"github.com/Kobiee88/peril/internal/routing"
+)
+
+// TestHandlers feeds the client's handlers a pause and state deltas through
+// an in-process broker, one delta arriving after another was missed.
+func TestHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := routing.Topology().Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := gamelogic.NewGameState("alice", gamelogic.DefaultScenario())
+	gs.LoadSnapshot(gamelogic.WorldSnapshot{})
+	pauses, err := pubsub.SubscribeJSON(ctx, conn, routing.ExchangePerilDirect, routing.PauseKey+".alice", routing.PauseKey, pubsub.TransientQueue, handlerPause(gs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pauses.Close()
+	joined := make(chan struct{}, 1)
+	join := func() error {
+		joined <- struct{}{}
+		return nil
+	}
+	deltas, err := pubsub.SubscribeJSON(ctx, conn, routing.ExchangePerilTopic, routing.StateDeltaPrefix+".alice", routing.StateDeltaPrefix+".*", pubsub.TransientQueue, handlerDelta(gs, join))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deltas.Close()
+
+	if err := pubsub.PublishJSON(pub, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: true}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the game to pause", func() bool {
+		_, err := gs.CommandMove([]string{"move", "asia", "1"})
+		return err != nil && err.Error() == "the game is paused, you can not move units"
+	})
+
+	unit := gamelogic.Unit{ID: 1, Owner: "alice", Rank: gamelogic.RankInfantry, Location: "europe", HP: 2}
+	for _, d := range []gamelogic.StateDelta{
+		{Seq: 1, Players: []gamelogic.PlayerDelta{{Username: "alice", Updated: []gamelogic.Unit{unit}, Spent: 1}}},
+		// Change 2 never arrives.
+		{Seq: 3},
+	} {
+		if err := pubsub.PublishJSON(pub, routing.ExchangePerilTopic, routing.StateDeltaPrefix+".alice", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("the client didn't catch up after missing a change")
+	}
+	if got, ok := gs.GetUnit(1); !ok || got != unit {
+		t.Errorf("unit 1 is %+v (%v), want %+v", got, ok, unit)
+	}
+}
+
+// TestHandlerWar checks that the client reports genuine war results and
+// discards any the server got wrong.
+func TestHandlerWar(t *testing.T) {
+	scenario := gamelogic.DefaultScenario()
+	rw := gamelogic.RecognitionOfWar{
+		Attacker: gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{
+			1: {ID: 1, Owner: "alice", Rank: gamelogic.RankCavalry, Location: "europe"},
+		}},
+		Defender: gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{
+			1: {ID: 1, Owner: "bob", Rank: gamelogic.RankInfantry, Location: "europe"},
+			2: {ID: 2, Owner: "bob", Rank: gamelogic.RankInfantry, Location: "europe"},
+		}},
+		Location: "europe",
+		Seed:     3,
+	}
+	tests := []struct {
+		name   string
+		tamper func(*gamelogic.WarResult)
+		want   pubsub.AckType
+	}{
+		{"genuine", func(*gamelogic.WarResult) {}, pubsub.Ack},
+		{"attacker power", func(r *gamelogic.WarResult) { r.AttackerPower++ }, pubsub.NackDiscard},
+		{"casualties", func(r *gamelogic.WarResult) { r.Casualties = nil }, pubsub.NackDiscard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := scenario.Fight(rw)
+			if !ok || len(r.Casualties) == 0 {
+				t.Fatalf("want a war with casualties, got %+v", r)
+			}
+			tt.tamper(&r)
+			if ack := handlerWar(gamelogic.NewGameState("bob", scenario))(r); ack != tt.want {
+				t.Errorf("got %v, want %v", ack, tt.want)
+			}
+		})
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kobiee88/peril/internal/gamelogic"
+	"github.com/Kobiee88/peril/internal/pubsub"
+	"github.com/Kobiee88/peril/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestPauseSpawnMove plays a game on an in-process broker: a player joins,
+// the server pauses and resumes, and the player spawns a unit and moves it,
+// through the same handlers the server serves RabbitMQ with.
+func TestPauseSpawnMove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := pubsub.NewMemoryBroker().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := routing.Topology().Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := pubsub.OpenKeystore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTestGame(t, ctx, conn, keys)
+	alice := newTestClient(t, ctx, conn, keys, "alice")
+
+	alice.join(ctx)
+	if d := alice.nextDelta(); d.Seq != 1 {
+		t.Fatalf("first broadcast is change %d, want 1", d.Seq)
+	}
+
+	if err := g.setPaused(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	alice.waitPaused(true)
+	if _, err := alice.gs.CommandMove([]string{"move", "asia", "1"}); err == nil {
+		t.Error("the client moved a unit while paused")
+	}
+	_, err = pubsub.Call[gamelogic.SpawnIntent, gamelogic.StateDelta](ctx, alice.rpc, routing.ExchangePerilDirect, routing.SpawnKey,
+		gamelogic.SpawnIntent{Location: "europe", Rank: gamelogic.RankCavalry}, pubsub.WithSignature(alice.signer))
+	var remote *pubsub.RemoteError
+	if !errors.As(err, &remote) || remote.Message != "the game is paused" {
+		t.Fatalf("spawning while paused = %v, want the game is paused", err)
+	}
+
+	if err := g.setPaused(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	alice.waitPaused(false)
+	spawn, err := alice.gs.CommandSpawn([]string{"spawn", "europe", "cavalry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := pubsub.Call[gamelogic.SpawnIntent, gamelogic.StateDelta](ctx, alice.rpc, routing.ExchangePerilDirect, routing.SpawnKey, spawn, pubsub.WithSignature(alice.signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.gs.ApplyDelta(d)
+	if broadcast := alice.nextDelta(); broadcast.Seq != d.Seq {
+		t.Errorf("broadcast change %d, replied with change %d", broadcast.Seq, d.Seq)
+	}
+	unit, ok := alice.gs.GetUnit(1)
+	if !ok || unit.Location != "europe" || unit.Rank != gamelogic.RankCavalry {
+		t.Fatalf("after spawning, unit 1 is %+v (%v), want cavalry in europe", unit, ok)
+	}
+
+	move, err := alice.gs.CommandMove([]string{"move", "asia", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = pubsub.Call[gamelogic.MoveIntent, gamelogic.StateDelta](ctx, alice.rpc, routing.ExchangePerilDirect, routing.MoveKey, move, pubsub.WithSignature(alice.signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.gs.ApplyDelta(d)
+	alice.nextDelta()
+	if unit, _ := alice.gs.GetUnit(1); unit.Location != "asia" {
+		t.Errorf("after moving, unit 1 is in %s, want asia", unit.Location)
+	}
+
+	// The world the server saved is the one it serves.
+	saved, err := gamelogic.LoadWorld(g.saveFile, gamelogic.DefaultScenario())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := saved.Snapshot().Seq, g.world.Snapshot().Seq; got != want {
+		t.Errorf("saved world is at change %d, want %d", got, want)
+	}
+}
+
+// TestSetPaused checks the flag is set before players are told, so no
+// intent gets in after they hear of a pause, and set back if they can't be.
+func TestSetPaused(t *testing.T) {
+	var pausedWhenPublished []bool
+	fail := false
+	g := &game{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	g.pub = publisherFunc(func() error {
+		pausedWhenPublished = append(pausedWhenPublished, g.paused.Load())
+		if fail {
+			return errors.New("connection lost")
+		}
+		return nil
+	})
+
+	if err := g.setPaused(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if !g.paused.Load() || !pausedWhenPublished[0] {
+		t.Errorf("paused %v, and %v when the pause went out; want true both times", g.paused.Load(), pausedWhenPublished[0])
+	}
+
+	fail = true
+	if err := g.setPaused(context.Background(), false); err == nil {
+		t.Fatal("resuming succeeded though the resume couldn't be published")
+	}
+	if !g.paused.Load() {
+		t.Error("the game resumed though the players weren't told")
+	}
+}
+
+type publisherFunc func() error
+
+func (f publisherFunc) PublishWithContext(context.Context, string, string, bool, bool, amqp.Publishing) error {
+	return f()
+}
+
+func newTestGame(t *testing.T, ctx context.Context, conn pubsub.Connection, keys *pubsub.Keystore) *game {
+	t.Helper()
+	signer, err := keys.Signer(routing.ServerSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directKey, err := keys.EnsureSecretKey(routing.DirectKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := pubsub.NewConfirmedPublisher(conn, time.Second)
+	t.Cleanup(func() { logs.Close() })
+	g := &game{
+		world:     gamelogic.NewWorld(gamelogic.DefaultScenario()),
+		saveFile:  filepath.Join(t.TempDir(), "save.json"),
+		pub:       pub,
+		logs:      logs,
+		signer:    signer,
+		pauseOpts: []pubsub.PublishOption{pubsub.WithSignature(signer), pubsub.WithEncryption(routing.DirectKeyName, directKey)},
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	served, err := g.serve(ctx, conn, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, sub := range served {
+			sub.Close()
+		}
+	})
+	return g
+}
+
+// testClient is a player's view of the game, kept up to date the way the
+// client keeps it.
+type testClient struct {
+	t      *testing.T
+	gs     *gamelogic.GameState
+	rpc    *pubsub.RPCClient
+	signer *pubsub.Signer
+	pauses chan routing.PlayingState
+	deltas chan gamelogic.StateDelta
+}
+
+func newTestClient(t *testing.T, ctx context.Context, conn pubsub.Connection, keys *pubsub.Keystore, username string) *testClient {
+	t.Helper()
+	signer, err := keys.Signer(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{
+		t:      t,
+		gs:     gamelogic.NewGameState(username, gamelogic.DefaultScenario()),
+		rpc:    pubsub.NewRPCClient(conn, pubsub.JSON, time.Second),
+		signer: signer,
+		pauses: make(chan routing.PlayingState, 16),
+		deltas: make(chan gamelogic.StateDelta, 16),
+	}
+	t.Cleanup(func() { c.rpc.Close() })
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fromServer := pubsub.WithMiddleware(pubsub.Verify(logger, keys), pubsub.Authorize(logger, pubsub.RequireSender(routing.ServerSender)))
+
+	pauses, err := pubsub.SubscribeJSON(ctx, conn, routing.ExchangePerilDirect, routing.PauseKey+"."+username, routing.PauseKey, pubsub.TransientQueue,
+		func(ps routing.PlayingState) pubsub.AckType {
+			c.gs.HandlePause(ps)
+			c.pauses <- ps
+			return pubsub.Ack
+		},
+		pubsub.WithLogger(logger), pubsub.WithDecryption(keys), fromServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pauses.Close() })
+	deltas, err := pubsub.SubscribeJSON(ctx, conn, routing.ExchangePerilTopic, routing.StateDeltaPrefix+"."+username, routing.StateDeltaPrefix+".*", pubsub.TransientQueue,
+		func(d gamelogic.StateDelta) pubsub.AckType {
+			c.gs.ApplyDelta(d)
+			c.deltas <- d
+			return pubsub.Ack
+		},
+		pubsub.WithLogger(logger), fromServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deltas.Close() })
+	return c
+}
+
+func (c *testClient) join(ctx context.Context) {
+	c.t.Helper()
+	snap, err := pubsub.Call[struct{}, gamelogic.WorldSnapshot](ctx, c.rpc, routing.ExchangePerilDirect, routing.JoinKey, struct{}{}, pubsub.WithSignature(c.signer))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.gs.LoadSnapshot(snap)
+}
+
+func (c *testClient) waitPaused(paused bool) {
+	c.t.Helper()
+	select {
+	case ps := <-c.pauses:
+		if ps.IsPaused != paused {
+			c.t.Fatalf("got playing state %+v, want paused %v", ps, paused)
+		}
+	case <-time.After(time.Second):
+		c.t.Fatalf("no playing state arrived, want paused %v", paused)
+	}
+}
+
+func (c *testClient) nextDelta() gamelogic.StateDelta {
+	c.t.Helper()
+	select {
+	case d := <-c.deltas:
+		return d
+	case <-time.After(time.Second):
+		c.t.Fatal("no state delta arrived")
+		return gamelogic.StateDelta{}
+	}
+}
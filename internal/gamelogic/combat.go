@@ -0,0 +1,94 @@
+package gamelogic
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// CombatRules say how wars are fought. Each round every unit on both sides
+// rolls a die; a roll plus the side's modifier of at least HitOn is a hit
+// dealing the unit's power in damage. Damage is taken by the other side's
+// units in ID order, each absorbing up to its hit points, and every unit
+// left without any dies. Wars last until a side has no units left or
+// MaxRounds have been fought.
+type CombatRules struct {
+	// Dice is the number of sides on a die, 6 if unset.
+	Dice int `json:"dice,omitempty"`
+	// HitOn is the lowest roll that hits, 4 if unset.
+	HitOn            int `json:"hit_on,omitempty"`
+	AttackerModifier int `json:"attacker_modifier,omitempty"`
+	DefenderModifier int `json:"defender_modifier,omitempty"`
+	// MaxRounds is 10 if unset.
+	MaxRounds int `json:"max_rounds,omitempty"`
+}
+
+func (c *CombatRules) setDefaults() {
+	if c.Dice == 0 {
+		c.Dice = 6
+	}
+	if c.HitOn == 0 {
+		c.HitOn = 4
+	}
+	if c.MaxRounds == 0 {
+		c.MaxRounds = 10
+	}
+}
+
+// battle fights attackers against defenders with dice seeded by seed, so
+// the same battle always goes the same way. It returns the units each side
+// has left, with their remaining hit points, and the number of rounds
+// fought.
+func (s *Scenario) battle(seed int64, attackers, defenders []Unit) (attackersLeft, defendersLeft []Unit, rounds int) {
+	rng := rand.New(rand.NewSource(seed))
+	rules := s.Combat
+	a := s.enlist(attackers)
+	d := s.enlist(defenders)
+	for rounds < rules.MaxRounds && len(a) > 0 && len(d) > 0 {
+		rounds++
+		// Both sides roll before either takes damage.
+		onDefenders := s.volley(rng, a, rules.AttackerModifier)
+		onAttackers := s.volley(rng, d, rules.DefenderModifier)
+		d = takeDamage(d, onDefenders)
+		a = takeDamage(a, onAttackers)
+	}
+	return a, d, rounds
+}
+
+// enlist returns copies of units in ID order, unhurt ones at their rank's
+// full hit points.
+func (s *Scenario) enlist(units []Unit) []Unit {
+	enlisted := make([]Unit, len(units))
+	copy(enlisted, units)
+	sort.Slice(enlisted, func(i, j int) bool { return enlisted[i].ID < enlisted[j].ID })
+	for i, u := range enlisted {
+		if u.HP <= 0 {
+			enlisted[i].HP = s.ranks[u.Rank].HP
+		}
+	}
+	return enlisted
+}
+
+// volley rolls for every unit, returning the damage they deal.
+func (s *Scenario) volley(rng *rand.Rand, units []Unit, modifier int) int {
+	damage := 0
+	for _, u := range units {
+		if rng.Intn(s.Combat.Dice)+1+modifier >= s.Combat.HitOn {
+			damage += s.ranks[u.Rank].Power
+		}
+	}
+	return damage
+}
+
+// takeDamage spreads damage over units in order and returns the survivors.
+func takeDamage(units []Unit, damage int) []Unit {
+	var alive []Unit
+	for _, u := range units {
+		hit := min(damage, u.HP)
+		u.HP -= hit
+		damage -= hit
+		if u.HP > 0 {
+			alive = append(alive, u)
+		}
+	}
+	return alive
+}
@@ -0,0 +1,171 @@
+package gamelogic
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// skirmish is a one-round scenario in which every roll hits, so wars go
+// the same way whatever their seed.
+const skirmish = `{
+  "name": "skirmish",
+  "territories": [{"name": "europe"}],
+  "ranks": [
+    {"name": "infantry", "power": 1, "hp": 2, "cost": 1, "speed": 1},
+    {"name": "cavalry", "power": 5, "hp": 6, "cost": 3, "speed": 2}
+  ],
+  "combat": {"dice": 6, "hit_on": 1, "max_rounds": 1},
+  "victory": {"last_standing": true}
+}`
+
+func TestFight(t *testing.T) {
+	s, err := ParseScenario("skirmish.json", []byte(skirmish))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		attackers []Unit
+		defenders []Unit
+		want      WarResult
+	}{
+		{
+			name:      "overkill is wasted",
+			attackers: []Unit{{ID: 1, Rank: RankCavalry}},
+			defenders: []Unit{{ID: 1, Rank: RankInfantry}, {ID: 2, Rank: RankInfantry}},
+			want: WarResult{
+				AttackerPower: 5, DefenderPower: 2, Rounds: 1, Winner: "attacker",
+				Casualties: []Casualties{
+					{Username: "attacker", Wounded: []Unit{{ID: 1, Owner: "attacker", Rank: RankCavalry, Location: "europe", HP: 4}}},
+					{Username: "defender", Killed: []UnitRef{{Owner: "defender", ID: 1}, {Owner: "defender", ID: 2}}},
+				},
+			},
+		},
+		{
+			name:      "damage goes to the lowest ID first",
+			attackers: []Unit{{ID: 1, Rank: RankInfantry}},
+			defenders: []Unit{{ID: 3, Rank: RankInfantry}, {ID: 2, Rank: RankInfantry}},
+			want: WarResult{
+				AttackerPower: 1, DefenderPower: 2, Rounds: 1, Winner: "defender",
+				Casualties: []Casualties{
+					{Username: "attacker", Killed: []UnitRef{{Owner: "attacker", ID: 1}}},
+					{Username: "defender", Wounded: []Unit{{ID: 2, Owner: "defender", Rank: RankInfantry, Location: "europe", HP: 1}}},
+				},
+			},
+		},
+		{
+			name:      "wounded units fight on with the hit points they have",
+			attackers: []Unit{{ID: 1, Rank: RankInfantry}},
+			defenders: []Unit{{ID: 1, Rank: RankInfantry, HP: 1}},
+			want: WarResult{
+				AttackerPower: 1, DefenderPower: 1, Rounds: 1, Winner: "attacker",
+				Casualties: []Casualties{
+					{Username: "attacker", Wounded: []Unit{{ID: 1, Owner: "attacker", Rank: RankInfantry, Location: "europe", HP: 1}}},
+					{Username: "defender", Killed: []UnitRef{{Owner: "defender", ID: 1}}},
+				},
+			},
+		},
+		{
+			name:      "both sides left standing is a draw",
+			attackers: []Unit{{ID: 1, Rank: RankCavalry}},
+			defenders: []Unit{{ID: 1, Rank: RankCavalry}},
+			want: WarResult{
+				AttackerPower: 5, DefenderPower: 5, Rounds: 1,
+				Casualties: []Casualties{
+					{Username: "attacker", Wounded: []Unit{{ID: 1, Owner: "attacker", Rank: RankCavalry, Location: "europe", HP: 1}}},
+					{Username: "defender", Wounded: []Unit{{ID: 1, Owner: "defender", Rank: RankCavalry, Location: "europe", HP: 1}}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := RecognitionOfWar{
+				Attacker: army("attacker", tt.attackers),
+				Defender: army("defender", tt.defenders),
+				Location: "europe",
+				Seed:     42,
+			}
+			got, ok := s.Fight(rw)
+			if !ok {
+				t.Fatal("no war was fought")
+			}
+			tt.want.War = rw
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFightSeeded fights wars with real dice: the same seed must give the
+// same result, even on another copy of the scenario.
+func TestFightSeeded(t *testing.T) {
+	rw := RecognitionOfWar{
+		Attacker: army("attacker", []Unit{{ID: 1, Rank: RankCavalry}, {ID: 2, Rank: RankInfantry}, {ID: 3, Rank: RankInfantry}}),
+		Defender: army("defender", []Unit{{ID: 1, Rank: RankArtillery}, {ID: 2, Rank: RankInfantry}}),
+		Location: "europe",
+	}
+	for _, seed := range []int64{0, 1, 42, -7, 1 << 40} {
+		rw.Seed = seed
+		first, ok := DefaultScenario().Fight(rw)
+		if !ok {
+			t.Fatal("no war was fought")
+		}
+		again, _ := DefaultScenario().Fight(rw)
+		if !reflect.DeepEqual(first, again) {
+			t.Errorf("seed %d: got %+v, then %+v", seed, first, again)
+		}
+	}
+}
+
+func TestCheckWar(t *testing.T) {
+	s, err := ParseScenario("skirmish.json", []byte(skirmish))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := RecognitionOfWar{
+		Attacker: army("attacker", []Unit{{ID: 1, Rank: RankCavalry}}),
+		Defender: army("defender", []Unit{{ID: 1, Rank: RankInfantry}, {ID: 2, Rank: RankInfantry}}),
+		Location: "europe",
+	}
+	tests := []struct {
+		name   string
+		tamper func(*WarResult)
+		ok     bool
+	}{
+		{"untouched", func(*WarResult) {}, true},
+		{"winner swapped", func(r *WarResult) { r.Winner = "defender" }, false},
+		{"called a draw", func(r *WarResult) { r.Winner = "" }, false},
+		{"more rounds", func(r *WarResult) { r.Rounds++ }, false},
+		{"power inflated", func(r *WarResult) { r.AttackerPower++ }, false},
+		{"casualty hidden", func(r *WarResult) { r.Casualties[1].Killed = r.Casualties[1].Killed[:1] }, false},
+		{"wound healed", func(r *WarResult) { r.Casualties[0].Wounded[0].HP = 6 }, false},
+		{"fought elsewhere", func(r *WarResult) { r.War.Location = "asia" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := s.Fight(rw)
+			tt.tamper(&r)
+			err := s.CheckWar(r)
+			if tt.ok && err != nil {
+				t.Errorf("CheckWar = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrBadWarResult) {
+				t.Errorf("CheckWar = %v, want ErrBadWarResult", err)
+			}
+		})
+	}
+}
+
+// army gives units to username in europe.
+func army(username string, units []Unit) Player {
+	p := Player{Username: username, Units: map[int]Unit{}}
+	for _, u := range units {
+		u.Owner = username
+		u.Location = "europe"
+		p.Units[u.ID] = u
+	}
+	return p
+}
@@ -1,5 +1,7 @@
 package gamelogic
 
+import "fmt"
+
 type Player struct {
 	Username string
 	Units    map[int]Unit
@@ -13,40 +15,41 @@ const (
 	RankArtillery = "artillery"
 )
 
+// Unit is one of a player's units. IDs are only unique within the owner's
+// army, and are never reused, even once the unit is dead.
 type Unit struct {
 	ID       int
+	Owner    string
 	Rank     UnitRank
 	Location Location
+	// HP is the unit's hit points left.
+	HP int
+}
+
+// UnitRef names a unit anywhere in the game.
+type UnitRef struct {
+	Owner string
+	ID    int
+}
+
+func (u Unit) Ref() UnitRef {
+	return UnitRef{Owner: u.Owner, ID: u.ID}
 }
 
-type ArmyMove struct {
-	Player     Player
-	Units      []Unit
-	ToLocation Location
+func (r UnitRef) String() string {
+	return fmt.Sprintf("%s#%d", r.Owner, r.ID)
 }
 
+// RecognitionOfWar is the units two players have in Location, where they
+// have met, as they stood when the attacker arrived, and the seed of the
+// dice the war is fought with. Units elsewhere take no part and are left
+// out. This keeps results small, not secret: every player sees every army
+// in the state deltas.
 type RecognitionOfWar struct {
 	Attacker Player
 	Defender Player
+	Location Location
+	Seed     int64
 }
 
 type Location string
-
-func getAllRanks() map[UnitRank]struct{} {
-	return map[UnitRank]struct{}{
-		RankInfantry:  {},
-		RankCavalry:   {},
-		RankArtillery: {},
-	}
-}
-
-func getAllLocations() map[Location]struct{} {
-	return map[Location]struct{}{
-		"americas":   {},
-		"europe":     {},
-		"africa":     {},
-		"asia":       {},
-		"australia":  {},
-		"antarctica": {},
-	}
-}
@@ -18,6 +18,7 @@ func PrintClientHelp() {
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* map")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -42,6 +43,13 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* status")
+	fmt.Println("* topology")
+	fmt.Println("* dlq list")
+	fmt.Println("* dlq show <n>")
+	fmt.Println("* dlq replay <n|all>")
+	fmt.Println("* dlq purge")
+	fmt.Println("* replay [first|last|<offset>|<duration>|<time>]")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +66,23 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// Inputs reads commands with GetInput in the background so a REPL can also
+// wait for other events. The channel is closed when stdin is exhausted.
+func Inputs() <-chan []string {
+	inputs := make(chan []string)
+	go func() {
+		defer close(inputs)
+		for {
+			words := GetInput()
+			if words == nil {
+				return
+			}
+			inputs <- words
+		}
+	}()
+	return inputs
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
@@ -77,7 +102,9 @@ func PrintQuit() {
 }
 
 func (gs *GameState) CommandStatus() {
-	if gs.isPaused() {
+	if winner, over := gs.gameOver(); over {
+		fmt.Printf("The game is over, %s won.\n", winner)
+	} else if gs.isPaused() {
 		fmt.Println("The game is paused.")
 		return
 	} else {
@@ -87,6 +114,30 @@ func (gs *GameState) CommandStatus() {
 	p := gs.GetPlayerSnap()
 	fmt.Printf("You are %s, and you have %d units.\n", p.Username, len(p.Units))
 	for _, unit := range p.Units {
-		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
+		fmt.Printf("* %v: %v, %v, %d hp\n", unit.ID, unit.Location, unit.Rank, unit.HP)
+	}
+	for _, other := range gs.getOthersSnap() {
+		if len(other.Units) == 0 {
+			fmt.Printf("%s has no units.\n", other.Username)
+			continue
+		}
+		fmt.Printf("%s has %d units in %s.\n", other.Username, len(other.Units), joinLocations(occupied(other)))
+	}
+}
+
+// CommandMap shows the scenario's map with the player's units on it.
+func (gs *GameState) CommandMap() {
+	fmt.Printf("Scenario: %s\n", gs.Scenario.Name)
+	fmt.Print(gs.Scenario.Map().Render(gs.getUnitsSnap()))
+	fmt.Println("Ranks:")
+	for _, r := range gs.Scenario.Ranks {
+		fmt.Printf("* %s: power %d, hp %d, cost %d, speed %d\n", r.Name, r.Power, r.HP, r.Cost, r.Speed)
+	}
+	c := gs.Scenario.Combat
+	fmt.Printf("Wars: units hit on %d+ on a d%d, attackers %+d, defenders %+d, for up to %d rounds\n",
+		c.HitOn, c.Dice, c.AttackerModifier, c.DefenderModifier, c.MaxRounds)
+	if gs.Scenario.SpawnBudget > 0 {
+		fmt.Printf("Spawn budget left: %d\n", gs.budgetLeft())
 	}
+	fmt.Printf("To win: %s\n", gs.Scenario.Victory)
 }
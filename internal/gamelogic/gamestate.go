@@ -1,23 +1,120 @@
 package gamelogic
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 )
 
+// GameState is a client's view of the world the server keeps: the player's
+// own army, everyone else's and whether the game is paused. It only changes
+// as the server says, through LoadSnapshot and ApplyDelta.
 type GameState struct {
-	Player Player
-	Paused bool
+	Player   Player
+	Paused   bool
+	Scenario *Scenario
+	// spent is the cost of the units the player has spawned.
+	spent  int
+	others map[string]Player
+	// seq is the last delta applied. Deltas arriving before the first
+	// snapshot wait in pending.
+	seq     uint64
+	synced  bool
+	pending []StateDelta
+	// winner is who won the game, once it is over.
+	winner string
 	mu     *sync.RWMutex
 }
 
-func NewGameState(username string) *GameState {
+func NewGameState(username string, scenario *Scenario) *GameState {
 	return &GameState{
 		Player: Player{
 			Username: username,
 			Units:    map[int]Unit{},
 		},
-		Paused: false,
-		mu:     &sync.RWMutex{},
+		Paused:   false,
+		Scenario: scenario,
+		others:   map[string]Player{},
+		mu:       &sync.RWMutex{},
+	}
+}
+
+// LoadSnapshot replaces the view with the world as the server sent it, then
+// applies any later deltas that arrived first.
+func (gs *GameState) LoadSnapshot(snap WorldSnapshot) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.Player.Units = map[int]Unit{}
+	gs.others = map[string]Player{}
+	for _, p := range snap.Players {
+		if p.Username == gs.Player.Username {
+			gs.Player.Units = copyPlayer(p).Units
+		} else {
+			gs.others[p.Username] = copyPlayer(p)
+		}
+	}
+	gs.spent = snap.Spent[gs.Player.Username]
+	gs.winner = snap.Winner
+	gs.seq = snap.Seq
+	gs.synced = true
+
+	pending := gs.pending
+	gs.pending = nil
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+	for _, d := range pending {
+		if d.Seq == gs.seq+1 {
+			gs.applyLocked(d)
+		}
+	}
+}
+
+// ApplyDelta updates the view with a change the server made, printing what
+// happened. Deltas already applied are ignored. It returns false if the view
+// has missed an earlier delta and needs a fresh snapshot.
+func (gs *GameState) ApplyDelta(d StateDelta) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if !gs.synced {
+		gs.pending = append(gs.pending, d)
+		return true
+	}
+	if d.Seq <= gs.seq {
+		return true
+	}
+	if d.Seq != gs.seq+1 {
+		return false
+	}
+	gs.applyLocked(d)
+	return true
+}
+
+func (gs *GameState) applyLocked(d StateDelta) {
+	for _, change := range d.Players {
+		p := gs.Player
+		if change.Username != gs.Player.Username {
+			p = gs.others[change.Username]
+			if p.Units == nil {
+				p = Player{Username: change.Username, Units: map[int]Unit{}}
+			}
+		} else {
+			gs.spent = change.Spent
+		}
+		for _, u := range change.Updated {
+			p.Units[u.ID] = u
+		}
+		for _, id := range change.Removed {
+			delete(p.Units, id)
+		}
+		if change.Username != gs.Player.Username {
+			gs.others[change.Username] = p
+		}
+	}
+	gs.seq = d.Seq
+	if d.Winner != "" {
+		gs.winner = d.Winner
+	}
+	for _, event := range d.Events {
+		fmt.Println(event)
 	}
 }
 
@@ -39,26 +136,17 @@ func (gs *GameState) isPaused() bool {
 	return gs.Paused
 }
 
-func (gs *GameState) addUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
-}
-
-func (gs *GameState) removeUnitsInLocation(loc Location) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	for k, v := range gs.Player.Units {
-		if v.Location == loc {
-			delete(gs.Player.Units, k)
-		}
-	}
+// gameOver returns who won the game, if it is over.
+func (gs *GameState) gameOver() (string, bool) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.winner, gs.winner != ""
 }
 
-func (gs *GameState) UpdateUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
+func (gs *GameState) budgetLeft() int {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.Scenario.SpawnBudget - gs.spent
 }
 
 func (gs *GameState) GetUsername() string {
@@ -75,6 +163,18 @@ func (gs *GameState) getUnitsSnap() []Unit {
 	return Units
 }
 
+// getOthersSnap returns the other players in name order.
+func (gs *GameState) getOthersSnap() []Player {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	others := make([]Player, 0, len(gs.others))
+	for _, p := range gs.others {
+		others = append(others, copyPlayer(p))
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Username < others[j].Username })
+	return others
+}
+
 func (gs *GameState) GetUnit(id int) (Unit, bool) {
 	gs.mu.RLock()
 	defer gs.mu.RUnlock()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Kobiee88/peril/internal/routing"
@@ -14,7 +15,13 @@ const logsFile = "game.log"
 const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	return WriteLogs([]routing.GameLog{gamelog})
+}
+
+// WriteLogs writes several game logs to disk at once, paying for the slow
+// write only once.
+func WriteLogs(gamelogs []routing.GameLog) error {
+	log.Printf("received %d game log(s)...", len(gamelogs))
 	time.Sleep(writeToDiskSleep)
 
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -23,8 +30,11 @@ func WriteLog(gamelog routing.GameLog) error {
 	}
 	defer f.Close()
 
-	str := fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
-	_, err = f.WriteString(str)
+	var str strings.Builder
+	for _, gamelog := range gamelogs {
+		fmt.Fprintf(&str, "%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+	}
+	_, err = f.WriteString(str.String())
 	if err != nil {
 		return fmt.Errorf("could not write to logs file: %v", err)
 	}
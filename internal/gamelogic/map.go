@@ -0,0 +1,147 @@
+package gamelogic
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Map is the graph of a scenario's territories. Adjacent territories are
+// joined by land, which units cross a hop at a time up to their rank's
+// speed. Sea routes join territories further apart: crossing one takes a
+// unit's whole move.
+type Map struct {
+	territories []Location
+	land        map[Location][]Location
+	sea         map[Location][]Location
+}
+
+func newMap(territories []Territory) *Map {
+	m := &Map{
+		land: map[Location][]Location{},
+		sea:  map[Location][]Location{},
+	}
+	for _, t := range territories {
+		m.territories = append(m.territories, t.Name)
+		m.land[t.Name] = nil
+		m.sea[t.Name] = nil
+	}
+	// Routes go both ways whichever side of them lists them.
+	for _, t := range territories {
+		for _, to := range t.Adjacent {
+			connect(m.land, t.Name, to)
+		}
+		for _, to := range t.SeaRoutes {
+			connect(m.sea, t.Name, to)
+		}
+	}
+	return m
+}
+
+func connect(routes map[Location][]Location, a, b Location) {
+	for _, l := range routes[a] {
+		if l == b {
+			return
+		}
+	}
+	routes[a] = append(routes[a], b)
+	routes[b] = append(routes[b], a)
+}
+
+// Has reports whether l is a territory on the map.
+func (m *Map) Has(l Location) bool {
+	_, ok := m.land[l]
+	return ok
+}
+
+// Territories returns every territory in the order the scenario lists them.
+func (m *Map) Territories() []Location {
+	return append([]Location(nil), m.territories...)
+}
+
+// Adjacent returns the territories joined to l by land.
+func (m *Map) Adjacent(l Location) []Location {
+	return append([]Location(nil), m.land[l]...)
+}
+
+// SeaRoutes returns the territories joined to l by sea.
+func (m *Map) SeaRoutes(l Location) []Location {
+	return append([]Location(nil), m.sea[l]...)
+}
+
+// Path returns the shortest route from one territory to another for a unit
+// that moves hops territories at a time, starting with from and ending with
+// to. It is false if the unit can't get there in one move.
+func (m *Map) Path(from, to Location, hops int) ([]Location, bool) {
+	if !m.Has(from) || !m.Has(to) {
+		return nil, false
+	}
+	if from == to {
+		return []Location{from}, true
+	}
+	for _, l := range m.sea[from] {
+		if l == to {
+			return []Location{from, to}, true
+		}
+	}
+
+	prev := map[Location]Location{from: ""}
+	frontier := []Location{from}
+	for depth := 0; depth < hops && len(frontier) > 0; depth++ {
+		var next []Location
+		for _, l := range frontier {
+			for _, n := range m.land[l] {
+				if _, seen := prev[n]; seen {
+					continue
+				}
+				prev[n] = l
+				if n == to {
+					path := []Location{to}
+					for at := l; at != ""; at = prev[at] {
+						path = append(path, at)
+					}
+					for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+						path[i], path[j] = path[j], path[i]
+					}
+					return path, true
+				}
+				next = append(next, n)
+			}
+		}
+		frontier = next
+	}
+	return nil, false
+}
+
+// Render draws the map as a list of territories, each with its routes and
+// the units there.
+func (m *Map) Render(units []Unit) string {
+	here := map[Location][]string{}
+	sort.Slice(units, func(i, j int) bool { return units[i].ID < units[j].ID })
+	for _, u := range units {
+		here[u.Location] = append(here[u.Location], fmt.Sprintf("%v %s", u.ID, u.Rank))
+	}
+
+	var b strings.Builder
+	for _, l := range m.territories {
+		fmt.Fprintf(&b, "%s\n", l)
+		if land := m.land[l]; len(land) > 0 {
+			fmt.Fprintf(&b, "  -- %s\n", joinLocations(land))
+		}
+		if sea := m.sea[l]; len(sea) > 0 {
+			fmt.Fprintf(&b, "  ~~ %s\n", joinLocations(sea))
+		}
+		if u := here[l]; len(u) > 0 {
+			fmt.Fprintf(&b, "  units: %s\n", strings.Join(u, ", "))
+		}
+	}
+	return b.String()
+}
+
+func joinLocations(ls []Location) string {
+	names := make([]string, len(ls))
+	for i, l := range ls {
+		names[i] = string(l)
+	}
+	return strings.Join(names, ", ")
+}
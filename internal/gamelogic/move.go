@@ -6,87 +6,44 @@ import (
 	"strconv"
 )
 
-type MoveOutcome int
-
-const (
-	MoveOutcomeSamePlayer MoveOutcome = iota
-	MoveOutComeSafe
-	MoveOutcomeMakeWar
-)
-
-func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
-	defer fmt.Println("------------------------")
-	player := gs.GetPlayerSnap()
-
-	fmt.Println()
-	fmt.Println("==== Move Detected ====")
-	fmt.Printf("%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
-	for _, unit := range move.Units {
-		fmt.Printf("* %v\n", unit.Rank)
-	}
-
-	if player.Username == move.Player.Username {
-		return MoveOutcomeSamePlayer
-	}
-
-	overlappingLocation := getOverlappingLocation(player, move.Player)
-	if overlappingLocation != "" {
-		fmt.Printf("You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
-		return MoveOutcomeMakeWar
-	}
-	fmt.Printf("You are safe from %s's units.\n", move.Player.Username)
-	return MoveOutComeSafe
-}
-
-func getOverlappingLocation(p1 Player, p2 Player) Location {
-	for _, u1 := range p1.Units {
-		for _, u2 := range p2.Units {
-			if u1.Location == u2.Location {
-				return u1.Location
-			}
-		}
-	}
-	return ""
-}
-
-func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+// CommandMove checks a move against the player's view of the world and
+// returns the intent to send the server, which has the final say.
+func (gs *GameState) CommandMove(words []string) (MoveIntent, error) {
 	if gs.isPaused() {
-		return ArmyMove{}, errors.New("the game is paused, you can not move units")
+		return MoveIntent{}, errors.New("the game is paused, you can not move units")
+	}
+	if winner, over := gs.gameOver(); over {
+		return MoveIntent{}, fmt.Errorf("the game is over, %s won", winner)
 	}
 	if len(words) < 3 {
-		return ArmyMove{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
+		return MoveIntent{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
 	}
 	newLocation := Location(words[1])
-	locations := getAllLocations()
-	if _, ok := locations[newLocation]; !ok {
-		return ArmyMove{}, fmt.Errorf("error: %s is not a valid location", newLocation)
+	if !gs.Scenario.Map().Has(newLocation) {
+		return MoveIntent{}, fmt.Errorf("error: %s is not a valid location", newLocation)
 	}
-	unitIDs := []int{}
+	units := []UnitRef{}
 	for _, word := range words[2:] {
 		id := word
 		unitID, err := strconv.Atoi(id)
 		if err != nil {
-			return ArmyMove{}, fmt.Errorf("error: %s is not a valid unit ID", id)
+			return MoveIntent{}, fmt.Errorf("error: %s is not a valid unit ID", id)
 		}
-		unitIDs = append(unitIDs, unitID)
+		units = append(units, UnitRef{Owner: gs.GetUsername(), ID: unitID})
 	}
 
-	newUnits := []Unit{}
-	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+	for _, ref := range units {
+		unit, ok := gs.GetUnit(ref.ID)
 		if !ok {
-			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
+			return MoveIntent{}, fmt.Errorf("error: unit with ID %v not found", ref.ID)
+		}
+		path, err := gs.Scenario.Route(unit, newLocation)
+		if err != nil {
+			return MoveIntent{}, fmt.Errorf("error: %w", err)
+		}
+		if len(path) > 2 {
+			fmt.Printf("Unit %v goes by way of %s\n", unit.ID, joinLocations(path[1:len(path)-1]))
 		}
-		unit.Location = newLocation
-		gs.UpdateUnit(unit)
-		newUnits = append(newUnits, unit)
-	}
-
-	mv := ArmyMove{
-		ToLocation: newLocation,
-		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
+	return MoveIntent{Units: units, ToLocation: newLocation}, nil
 }
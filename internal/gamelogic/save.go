@@ -0,0 +1,118 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrSaveLocked is returned by LockSave when another server is already
+// carrying on the saved game.
+var ErrSaveLocked = errors.New("the saved game is in use by another server")
+
+// savedGame is a World as it is written to disk.
+type savedGame struct {
+	Scenario string         `json:"scenario"`
+	Seq      uint64         `json:"seq"`
+	Players  []Player       `json:"players"`
+	Spent    map[string]int `json:"spent"`
+	LastID   map[string]int `json:"last_id"`
+	Winner   string         `json:"winner,omitempty"`
+}
+
+// Save writes the world to path, replacing any earlier save only once the
+// new one is safely written.
+func (w *World) Save(path string) error {
+	w.mu.Lock()
+	saved := savedGame{
+		Scenario: w.scenario.Name,
+		Seq:      w.seq,
+		Winner:   w.winner,
+		Spent:    map[string]int{},
+		LastID:   map[string]int{},
+	}
+	for _, name := range w.joined {
+		saved.Players = append(saved.Players, copyPlayer(*w.players[name]))
+		saved.Spent[name] = w.spent[name]
+		saved.LastID[name] = w.lastID[name]
+	}
+	w.mu.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode saved game: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create saved game: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write saved game: %v", err)
+	}
+	// Sync before renaming, or a crash could leave the rename on disk
+	// without the data.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write saved game: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not write saved game: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("could not replace saved game: %v", err)
+	}
+	return nil
+}
+
+// LoadWorld carries on the game saved at path, or starts a new one if
+// nothing has been saved there yet. The save must be of the same scenario,
+// with every unit of a rank it has and on its map.
+func LoadWorld(path string, scenario *Scenario) (*World, error) {
+	w := NewWorld(scenario)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read saved game: %v", err)
+	}
+	var saved savedGame
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("could not decode saved game %s: %v", path, err)
+	}
+	if saved.Scenario != scenario.Name {
+		return nil, fmt.Errorf("%s is a game of %s, not %s", path, saved.Scenario, scenario.Name)
+	}
+
+	w.seq = saved.Seq
+	w.winner = saved.Winner
+	for _, p := range saved.Players {
+		p := copyPlayer(p)
+		for id, unit := range p.Units {
+			if _, ok := scenario.Rank(unit.Rank); !ok {
+				return nil, fmt.Errorf("%s: %s's unit %d has rank %s, which %s doesn't have", path, p.Username, id, unit.Rank, scenario.Name)
+			}
+			if !scenario.Map().Has(unit.Location) {
+				return nil, fmt.Errorf("%s: %s's unit %d is in %s, which isn't on the map of %s", path, p.Username, id, unit.Location, scenario.Name)
+			}
+			// Units saved before they had owners belong to whoever has them.
+			unit.ID = id
+			unit.Owner = p.Username
+			p.Units[id] = unit
+		}
+		w.players[p.Username] = &p
+		w.joined = append(w.joined, p.Username)
+		w.spent[p.Username] = saved.Spent[p.Username]
+		// Never hand out an ID a unit still has, whatever the save says.
+		w.lastID[p.Username] = saved.LastID[p.Username]
+		for id := range p.Units {
+			w.lastID[p.Username] = max(w.lastID[p.Username], id)
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// LockSave claims the game saved at path for this process, so no other
+// server on the machine carries it on at the same time. The lock is held
+// until unlock is called or the process exits.
+func LockSave(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open save lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrSaveLocked
+		}
+		return nil, fmt.Errorf("could not lock saved game: %v", err)
+	}
+	return func() { f.Close() }, nil
+}
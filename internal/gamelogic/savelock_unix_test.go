@@ -0,0 +1,26 @@
+//go:build unix
+
+package gamelogic
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.json")
+	unlock, err := LockSave(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockSave(path); !errors.Is(err, ErrSaveLocked) {
+		t.Fatalf("locking a locked save = %v, want ErrSaveLocked", err)
+	}
+	unlock()
+	unlock, err = LockSave(path)
+	if err != nil {
+		t.Fatalf("locking an unlocked save: %v", err)
+	}
+	unlock()
+}
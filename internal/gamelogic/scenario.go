@@ -0,0 +1,557 @@
+package gamelogic
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed scenarios/world.json
+var worldScenario []byte
+
+// AnyPlayer keys the starting army of players a scenario doesn't name.
+const AnyPlayer = "*"
+
+// Scenario sets up a game: its map, the ranks units can have, the armies
+// players start with and what it takes to win. Scenarios are written as
+// JSON; see scenarios/world.json for the default one.
+type Scenario struct {
+	Name        string      `json:"name"`
+	Territories []Territory `json:"territories"`
+	Ranks       []RankSpec  `json:"ranks"`
+	// StartingUnits are the armies players start with, by username, with
+	// AnyPlayer's going to everyone else.
+	StartingUnits map[string][]StartingUnit `json:"starting_units,omitempty"`
+	// SpawnBudget, if positive, bounds the total cost of the units a player
+	// spawns.
+	SpawnBudget int               `json:"spawn_budget,omitempty"`
+	Combat      CombatRules       `json:"combat,omitempty"`
+	Victory     VictoryConditions `json:"victory"`
+
+	world *Map
+	ranks map[UnitRank]RankSpec
+}
+
+// Territory is a place on the map. Its routes only need listing on one
+// side.
+type Territory struct {
+	Name      Location   `json:"name"`
+	Adjacent  []Location `json:"adjacent,omitempty"`
+	SeaRoutes []Location `json:"sea_routes,omitempty"`
+}
+
+// RankSpec defines a unit rank. Power is the damage each unit deals when it
+// hits in a war and HP the damage it can take, 1 if unset. Cost is what
+// spawning one takes from the spawn budget and Speed how many territories it
+// crosses by land in one move.
+type RankSpec struct {
+	Name  UnitRank `json:"name"`
+	Power int      `json:"power"`
+	HP    int      `json:"hp,omitempty"`
+	Cost  int      `json:"cost"`
+	Speed int      `json:"speed"`
+}
+
+// StartingUnit puts Count units of a rank in a territory.
+type StartingUnit struct {
+	Rank     UnitRank `json:"rank"`
+	Location Location `json:"location"`
+	Count    int      `json:"count"`
+}
+
+// VictoryConditions are the ways to win a game; meeting any one of them is
+// enough. A player holds a territory when they have units there and nobody
+// else does.
+type VictoryConditions struct {
+	HoldTerritories int        `json:"hold_territories,omitempty"`
+	Capitals        []Location `json:"capitals,omitempty"`
+	// LastStanding wins for the only player with units left.
+	LastStanding bool `json:"last_standing,omitempty"`
+}
+
+func (v VictoryConditions) String() string {
+	var ways []string
+	if v.HoldTerritories > 0 {
+		ways = append(ways, fmt.Sprintf("hold %d territories", v.HoldTerritories))
+	}
+	if len(v.Capitals) > 0 {
+		ways = append(ways, "hold "+joinLocations(v.Capitals))
+	}
+	if v.LastStanding {
+		ways = append(ways, "be the last player with units")
+	}
+	return strings.Join(ways, ", or ")
+}
+
+// ScenarioError is a problem with a scenario, pointing at the line of the
+// file it is in when it came from one.
+type ScenarioError struct {
+	File   string
+	Line   int
+	Column int
+	// Path is where in the scenario the problem is, such as
+	// territories[2].adjacent[0].
+	Path string
+	Msg  string
+}
+
+func (e *ScenarioError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", e.Line, e.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ScenarioErrors is every problem found with a scenario.
+type ScenarioErrors []*ScenarioError
+
+func (errs ScenarioErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DefaultScenario is the built-in world: six continents and the three
+// classic ranks.
+func DefaultScenario() *Scenario {
+	s, err := ParseScenario("world.json", worldScenario)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// LoadScenario reads and validates the scenario file at path.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load scenario: %w", err)
+	}
+	return ParseScenario(path, data)
+}
+
+// ParseScenario decodes and validates a scenario. Problems are reported as
+// ScenarioErrors giving the line and column in data, and file as the name
+// of the file.
+func ParseScenario(file string, data []byte) (*Scenario, error) {
+	var s Scenario
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		e := decodeError(data, err)
+		e.File = file
+		return nil, ScenarioErrors{e}
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		e := &ScenarioError{File: file, Msg: "unexpected data after the scenario"}
+		rest := bytes.TrimLeft(data[end:], " \t\r\n")
+		e.Line, e.Column = lineColumn(data, int64(len(data)-len(rest)))
+		return nil, ScenarioErrors{e}
+	}
+
+	if err := s.Validate(); err != nil {
+		var errs ScenarioErrors
+		if !errors.As(err, &errs) {
+			return nil, err
+		}
+		values, _ := jsonPaths(data)
+		for _, e := range errs {
+			e.File = file
+			e.Line, e.Column = lineColumn(data, locate(values, e.Path))
+		}
+		return nil, errs
+	}
+	return &s, nil
+}
+
+// Validate checks that everything the scenario refers to is defined and
+// that its numbers make sense, returning ScenarioErrors if not. It must be
+// called before the scenario is used, as ParseScenario does; scenarios
+// received from elsewhere need validating themselves.
+func (s *Scenario) Validate() error {
+	var errs ScenarioErrors
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, &ScenarioError{Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	territories := map[Location]bool{}
+	if len(s.Territories) == 0 {
+		fail("territories", "a scenario needs at least one territory")
+	}
+	for i, t := range s.Territories {
+		path := fmt.Sprintf("territories[%d].name", i)
+		if !isName(string(t.Name)) {
+			fail(path, "territory name %q must be a single word", t.Name)
+		} else if territories[t.Name] {
+			fail(path, "territory %s is defined twice", t.Name)
+		}
+		territories[t.Name] = true
+	}
+	checkTerritory := func(path string, l Location) bool {
+		if !territories[l] {
+			fail(path, "unknown territory %q", l)
+			return false
+		}
+		return true
+	}
+	for i, t := range s.Territories {
+		routes := map[string][]Location{"adjacent": t.Adjacent, "sea_routes": t.SeaRoutes}
+		for _, kind := range []string{"adjacent", "sea_routes"} {
+			for j, l := range routes[kind] {
+				path := fmt.Sprintf("territories[%d].%s[%d]", i, kind, j)
+				if checkTerritory(path, l) && l == t.Name {
+					fail(path, "%s can't border itself", l)
+				}
+			}
+		}
+	}
+
+	ranks := map[UnitRank]RankSpec{}
+	if len(s.Ranks) == 0 {
+		fail("ranks", "a scenario needs at least one rank")
+	}
+	for i, r := range s.Ranks {
+		path := fmt.Sprintf("ranks[%d]", i)
+		if !isName(string(r.Name)) {
+			fail(path+".name", "rank name %q must be a single word", r.Name)
+		} else if _, ok := ranks[r.Name]; ok {
+			fail(path+".name", "rank %s is defined twice", r.Name)
+		}
+		if r.Power < 0 {
+			fail(path+".power", "power can't be negative")
+		}
+		if r.Cost < 0 {
+			fail(path+".cost", "cost can't be negative")
+		}
+		if r.Speed < 1 {
+			fail(path+".speed", "speed must be at least 1")
+		}
+		if r.HP < 0 {
+			fail(path+".hp", "hit points can't be negative")
+		} else if r.HP == 0 {
+			s.Ranks[i].HP = 1
+		}
+		ranks[r.Name] = s.Ranks[i]
+	}
+
+	c := &s.Combat
+	c.setDefaults()
+	if c.Dice < 2 {
+		fail("combat.dice", "dice need at least 2 sides")
+	}
+	if c.HitOn < 1 {
+		fail("combat.hit_on", "must be at least 1")
+	}
+	if c.MaxRounds < 1 {
+		fail("combat.max_rounds", "must be at least 1")
+	}
+
+	players := make([]string, 0, len(s.StartingUnits))
+	for player := range s.StartingUnits {
+		players = append(players, player)
+	}
+	sort.Strings(players)
+	for _, player := range players {
+		path := "starting_units." + player
+		if player != AnyPlayer && !isName(player) {
+			fail(path, "player name %q must be a single word", player)
+		}
+		for i, u := range s.StartingUnits[player] {
+			at := fmt.Sprintf("%s[%d]", path, i)
+			if _, ok := ranks[u.Rank]; !ok {
+				fail(at+".rank", "unknown rank %q", u.Rank)
+			}
+			checkTerritory(at+".location", u.Location)
+			if u.Count < 1 {
+				fail(at+".count", "count must be at least 1")
+			}
+		}
+	}
+	if s.SpawnBudget < 0 {
+		fail("spawn_budget", "spawn budget can't be negative")
+	}
+
+	v := s.Victory
+	if v.HoldTerritories < 0 || v.HoldTerritories > len(s.Territories) {
+		fail("victory.hold_territories", "must be between 0 and the number of territories, %d", len(s.Territories))
+	}
+	for i, l := range v.Capitals {
+		checkTerritory(fmt.Sprintf("victory.capitals[%d]", i), l)
+	}
+	if v.HoldTerritories == 0 && len(v.Capitals) == 0 && !v.LastStanding {
+		fail("victory", "a scenario needs at least one victory condition")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	s.world = newMap(s.Territories)
+	s.ranks = ranks
+	return nil
+}
+
+// Map returns the scenario's map.
+func (s *Scenario) Map() *Map {
+	return s.world
+}
+
+// Rank returns the definition of rank r.
+func (s *Scenario) Rank(r UnitRank) (RankSpec, bool) {
+	spec, ok := s.ranks[r]
+	return spec, ok
+}
+
+// Power is the combined power of units in a war.
+func (s *Scenario) Power(units []Unit) int {
+	power := 0
+	for _, unit := range units {
+		power += s.ranks[unit.Rank].Power
+	}
+	return power
+}
+
+// Route returns the path unit takes to a territory, or an error if it can't
+// get there in one move.
+func (s *Scenario) Route(unit Unit, to Location) ([]Location, error) {
+	spec, ok := s.Rank(unit.Rank)
+	if !ok {
+		return nil, fmt.Errorf("unit %v has unknown rank %s", unit.ID, unit.Rank)
+	}
+	path, ok := s.Map().Path(unit.Location, to, spec.Speed)
+	if !ok {
+		return nil, fmt.Errorf("unit %v (%s) can't reach %s from %s in one move", unit.ID, unit.Rank, to, unit.Location)
+	}
+	return path, nil
+}
+
+// StartingArmy returns the units player starts the game with.
+func (s *Scenario) StartingArmy(player string) []StartingUnit {
+	if army, ok := s.StartingUnits[player]; ok {
+		return army
+	}
+	return s.StartingUnits[AnyPlayer]
+}
+
+// Winner returns the player who has met a victory condition, judging by
+// every player's units.
+func (s *Scenario) Winner(players []Player) (string, bool) {
+	occupiers := map[Location]map[string]bool{}
+	var alive []string
+	for _, p := range players {
+		if len(p.Units) > 0 {
+			alive = append(alive, p.Username)
+		}
+		for _, u := range p.Units {
+			if occupiers[u.Location] == nil {
+				occupiers[u.Location] = map[string]bool{}
+			}
+			occupiers[u.Location][p.Username] = true
+		}
+	}
+	held := map[string]map[Location]bool{}
+	for l, names := range occupiers {
+		if len(names) != 1 {
+			continue
+		}
+		for name := range names {
+			if held[name] == nil {
+				held[name] = map[Location]bool{}
+			}
+			held[name][l] = true
+		}
+	}
+
+	v := s.Victory
+	if v.LastStanding && len(players) > 1 && len(alive) == 1 {
+		return alive[0], true
+	}
+	for _, p := range players {
+		h := held[p.Username]
+		if v.HoldTerritories > 0 && len(h) >= v.HoldTerritories {
+			return p.Username, true
+		}
+		if len(v.Capitals) > 0 && holdsAll(h, v.Capitals) {
+			return p.Username, true
+		}
+	}
+	return "", false
+}
+
+func holdsAll(held map[Location]bool, ls []Location) bool {
+	for _, l := range ls {
+		if !held[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// isName reports whether s can be typed as one word of a command.
+func isName(s string) bool {
+	fields := strings.Fields(s)
+	return len(fields) == 1 && fields[0] == s
+}
+
+// decodeError turns an error decoding data into a ScenarioError at the
+// offending line.
+func decodeError(data []byte, err error) *ScenarioError {
+	e := &ScenarioError{Msg: err.Error()}
+	offset := int64(len(data))
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The offset is just past the character the decoder choked on.
+		offset = max(syntaxErr.Offset-1, 0)
+		e.Msg = syntaxErr.Error()
+	case errors.As(err, &typeErr):
+		// The offset is the end of the value, so look up where it starts.
+		offset = typeErr.Offset
+		e.Path = fieldPath(typeErr.Field)
+		values, _ := jsonPaths(data)
+		if off, ok := values[e.Path]; ok {
+			offset = off
+		}
+		e.Msg = fmt.Sprintf("expected %s, not %s", typeErr.Type, typeErr.Value)
+	case errors.Is(err, io.EOF):
+		offset = 0
+		e.Msg = "the scenario is empty"
+	case strings.HasPrefix(err.Error(), `json: unknown field "`):
+		// The decoder doesn't say where, so point at the first key by
+		// that name.
+		name := strings.TrimSuffix(strings.TrimPrefix(err.Error(), `json: unknown field "`), `"`)
+		e.Msg = fmt.Sprintf("unknown field %q", name)
+		_, keys := jsonPaths(data)
+		offset = -1
+		for path, off := range keys {
+			if (path == name || strings.HasSuffix(path, "."+name)) && (offset < 0 || off < offset) {
+				e.Path, offset = path, off
+			}
+		}
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	e.Line, e.Column = lineColumn(data, offset)
+	return e
+}
+
+// fieldPath turns the decoder's name for a field, such as ranks.0.power,
+// into a path like ranks[0].power.
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// jsonPaths maps the path of every value in a JSON document, such as
+// territories[2].adjacent[0], to the offset the value starts at, and the
+// path of every object member to the offset of its key. It gives up
+// quietly on malformed documents.
+func jsonPaths(data []byte) (values, keys map[string]int64) {
+	values = map[string]int64{}
+	keys = map[string]int64{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// The decoder's offset is the end of the last token, before any
+	// separator, so skip ahead to where the next one starts.
+	next := func() int64 {
+		off := dec.InputOffset()
+		for off < int64(len(data)) && strings.ContainsRune(" \t\r\n:,", rune(data[off])) {
+			off++
+		}
+		return off
+	}
+	var walk func(path string) error
+	walk = func(path string) error {
+		values[path] = next()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				off := next()
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := tok.(string)
+				if path != "" {
+					key = path + "." + key
+				}
+				keys[key] = off
+				if err := walk(key); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("")
+	return values, keys
+}
+
+// locate returns the offset of the value at path, or of the closest
+// enclosing value the document has.
+func locate(values map[string]int64, path string) int64 {
+	for {
+		if off, ok := values[path]; ok {
+			return off
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return values[""]
+		}
+		path = path[:i]
+	}
+}
+
+// lineColumn converts an offset in data to a 1-based line and column.
+func lineColumn(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
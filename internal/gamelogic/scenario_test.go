@@ -0,0 +1,100 @@
+package gamelogic
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseScenarioErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{
+			name: "malformed",
+			json: "{\n  \"name\": \"broken\"\n  \"territories\": []\n}",
+			want: "bad.json:3:3: invalid character '\"' after object key:value pair",
+		},
+		{
+			name: "wrong type",
+			json: "{\n  \"name\": \"typo\",\n  \"ranks\": [{\"name\": \"infantry\", \"power\": \"high\"}]\n}",
+			want: "bad.json:3:43: ranks[0].power: expected int, not string",
+		},
+		{
+			name: "unknown field",
+			json: "{\n  \"name\": \"typo\",\n  \"ranks\": [\n    {\"name\": \"infantry\", \"strength\": 1}\n  ]\n}",
+			want: `bad.json:4:26: ranks[0].strength: unknown field "strength"`,
+		},
+		{
+			name: "empty",
+			json: "",
+			want: "bad.json:1:1: the scenario is empty",
+		},
+		{
+			name: "trailing data",
+			json: "{\"name\": \"twice\"}\n{}",
+			want: "bad.json:2:1: unexpected data after the scenario",
+		},
+		{
+			name: "failed validation",
+			json: `{
+  "name": "invalid",
+  "territories": [
+    {"name": "europe", "adjacent": ["asia"]}
+  ],
+  "ranks": [
+    {"name": "infantry", "power": -1, "hp": 1, "speed": 1}
+  ],
+  "victory": {"last_standing": true}
+}`,
+			want: strings.Join([]string{
+				`bad.json:4:37: territories[0].adjacent[0]: unknown territory "asia"`,
+				`bad.json:7:35: ranks[0].power: power can't be negative`,
+			}, "\n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseScenario("bad.json", []byte(tt.json))
+			var errs ScenarioErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("got %v, want ScenarioErrors", err)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadScenario(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "skirmish.json")
+	if err := os.WriteFile(path, []byte(skirmish), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadScenario(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "skirmish" {
+		t.Errorf("loaded %q, want skirmish", s.Name)
+	}
+
+	// Errors name the file they are in.
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte("{\n  \"name\": 7\n}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScenario(bad); err == nil || err.Error() != bad+":2:11: name: expected string, not number" {
+		t.Errorf("got %v, want the bad name's line and column", err)
+	}
+
+	if _, err := LoadScenario(filepath.Join(dir, "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a missing file", err)
+	}
+}
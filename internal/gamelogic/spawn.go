@@ -5,30 +5,28 @@ import (
 	"fmt"
 )
 
-func (gs *GameState) CommandSpawn(words []string) error {
+// CommandSpawn checks a spawn against the player's view of the world and
+// returns the intent to send the server, which has the final say.
+func (gs *GameState) CommandSpawn(words []string) (SpawnIntent, error) {
+	if winner, over := gs.gameOver(); over {
+		return SpawnIntent{}, fmt.Errorf("the game is over, %s won", winner)
+	}
 	if len(words) < 3 {
-		return errors.New("usage: spawn <location> <rank>")
+		return SpawnIntent{}, errors.New("usage: spawn <location> <rank>")
 	}
 
 	locationName := words[1]
-	locations := getAllLocations()
-	if _, ok := locations[Location(locationName)]; !ok {
-		return fmt.Errorf("error: %s is not a valid location", locationName)
+	if !gs.Scenario.Map().Has(Location(locationName)) {
+		return SpawnIntent{}, fmt.Errorf("error: %s is not a valid location", locationName)
 	}
 
 	rank := words[2]
-	units := getAllRanks()
-	if _, ok := units[UnitRank(rank)]; !ok {
-		return fmt.Errorf("error: %s is not a valid unit", rank)
+	spec, ok := gs.Scenario.Rank(UnitRank(rank))
+	if !ok {
+		return SpawnIntent{}, fmt.Errorf("error: %s is not a valid unit", rank)
 	}
-
-	id := len(gs.getUnitsSnap()) + 1
-	gs.addUnit(Unit{
-		ID:       id,
-		Rank:     UnitRank(rank),
-		Location: Location(locationName),
-	})
-
-	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
-	return nil
+	if left := gs.budgetLeft(); gs.Scenario.SpawnBudget > 0 && spec.Cost > left {
+		return SpawnIntent{}, fmt.Errorf("error: a(n) %s costs %d, more than the %d left of your budget", rank, spec.Cost, left)
+	}
+	return SpawnIntent{Location: Location(locationName), Rank: UnitRank(rank)}, nil
 }
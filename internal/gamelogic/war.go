@@ -1,105 +1,223 @@
 package gamelogic
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 )
 
 type WarOutcome int
 
 const (
 	WarOutcomeNotInvolved WarOutcome = iota
-	WarOutcomeNoUnits
 	WarOutcomeYouWon
 	WarOutcomeOpponentWon
 	WarOutcomeDraw
 )
 
-func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
-	fmt.Println("==== War Declared ====")
-	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
+// ErrBadWarResult is returned for war results that don't follow from the war
+// they were fought over.
+var ErrBadWarResult = errors.New("war result doesn't follow from the war")
+
+// WarResult is how a war turned out. The server sends it to both
+// belligerents, with everything it was worked out from in War so either side
+// can check it. It only reports the war: the casualties reach every view,
+// the belligerents' included, in the state delta. Every player sees every
+// army anyway, so the outcome is no secret, and one source of changes keeps
+// all views in step.
+type WarResult struct {
+	War           RecognitionOfWar
+	AttackerPower int
+	DefenderPower int
+	Rounds        int
+	// Winner is the only side with units left, or empty after a draw.
+	Winner     string
+	Casualties []Casualties
+}
 
-	player := gs.GetPlayerSnap()
+// Casualties are what one side lost in a war: the units killed, and the
+// units wounded as they were left.
+type Casualties struct {
+	Username string
+	Killed   []UnitRef
+	Wounded  []Unit
+}
 
-	if player.Username == rw.Defender.Username {
-		fmt.Printf("%s, you published the war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+// Loser is the side that lost, or empty after a draw.
+func (r WarResult) Loser() string {
+	switch r.Winner {
+	case r.War.Attacker.Username:
+		return r.War.Defender.Username
+	case r.War.Defender.Username:
+		return r.War.Attacker.Username
 	}
+	return ""
+}
 
-	if player.Username != rw.Attacker.Username {
-		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+func (r WarResult) String() string {
+	outcome := "the war ended in a draw"
+	if r.Winner != "" {
+		outcome = r.Winner + " won"
 	}
+	return fmt.Sprintf("%s (power %d) attacked %s (power %d) in %s: %s after %d round(s)",
+		r.War.Attacker.Username, r.AttackerPower, r.War.Defender.Username, r.DefenderPower, r.War.Location, outcome, r.Rounds)
+}
 
-	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
-	if overlappingLocation == "" {
-		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
-		return WarOutcomeNoUnits, "", ""
+// Fight settles a war between the units both sides have where it was
+// declared, as the scenario's combat rules say, with the war's seed for the
+// dice. The same war always has the same result. It is false if they don't
+// both have units there.
+func (s *Scenario) Fight(rw RecognitionOfWar) (WarResult, bool) {
+	attackerUnits := unitsIn(rw.Attacker, rw.Location)
+	defenderUnits := unitsIn(rw.Defender, rw.Location)
+	if len(attackerUnits) == 0 || len(defenderUnits) == 0 {
+		return WarResult{}, false
 	}
 
-	attackerUnits := []Unit{}
-	defenderUnits := []Unit{}
-	for _, unit := range rw.Attacker.Units {
-		if unit.Location == overlappingLocation {
-			attackerUnits = append(attackerUnits, unit)
+	attackersLeft, defendersLeft, rounds := s.battle(rw.Seed, attackerUnits, defenderUnits)
+	result := WarResult{
+		War:           rw,
+		AttackerPower: s.Power(attackerUnits),
+		DefenderPower: s.Power(defenderUnits),
+		Rounds:        rounds,
+	}
+	switch {
+	case len(defendersLeft) == 0 && len(attackersLeft) > 0:
+		result.Winner = rw.Attacker.Username
+	case len(attackersLeft) == 0 && len(defendersLeft) > 0:
+		result.Winner = rw.Defender.Username
+	}
+	for _, side := range []struct {
+		username      string
+		before, after []Unit
+	}{
+		{rw.Attacker.Username, s.enlist(attackerUnits), attackersLeft},
+		{rw.Defender.Username, s.enlist(defenderUnits), defendersLeft},
+	} {
+		if lost, ok := casualties(side.username, side.before, side.after); ok {
+			result.Casualties = append(result.Casualties, lost)
 		}
 	}
-	for _, unit := range rw.Defender.Units {
-		if unit.Location == overlappingLocation {
-			defenderUnits = append(defenderUnits, unit)
+	return result, true
+}
+
+// casualties compares a side's units before and after a battle, both in ID
+// order. It is false if the side lost nothing.
+func casualties(username string, before, after []Unit) (Casualties, bool) {
+	lost := Casualties{Username: username}
+	left := map[int]Unit{}
+	for _, u := range after {
+		left[u.ID] = u
+	}
+	for _, u := range before {
+		survivor, ok := left[u.ID]
+		if !ok {
+			lost.Killed = append(lost.Killed, u.Ref())
+		} else if survivor.HP < u.HP {
+			lost.Wounded = append(lost.Wounded, survivor)
 		}
 	}
+	return lost, len(lost.Killed) > 0 || len(lost.Wounded) > 0
+}
 
-	fmt.Printf("%s's units:\n", rw.Attacker.Username)
-	for _, unit := range attackerUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
-	}
-	fmt.Printf("%s's units:\n", rw.Defender.Username)
-	for _, unit := range defenderUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
-	}
-	attackerPower := unitsToPowerLevel(attackerUnits)
-	defenderPower := unitsToPowerLevel(defenderUnits)
-	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
-	fmt.Printf("Defender has a power level of %v\n", defenderPower)
-	if attackerPower > defenderPower {
-		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
-		if player.Username == rw.Defender.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
+// CheckWar fights r's war again, returning ErrBadWarResult if it turns out
+// differently.
+func (s *Scenario) CheckWar(r WarResult) error {
+	want, ok := s.Fight(r.War)
+	if !ok {
+		return fmt.Errorf("%w: nobody to fight in %s", ErrBadWarResult, r.War.Location)
+	}
+	if r.AttackerPower != want.AttackerPower || r.DefenderPower != want.DefenderPower || r.Rounds != want.Rounds ||
+		r.Winner != want.Winner || !reflect.DeepEqual(r.Casualties, want.Casualties) {
+		return fmt.Errorf("%w: expected %s", ErrBadWarResult, want)
+	}
+	return nil
+}
+
+// HandleWar checks a war result the server sent and reports how it went.
+// It leaves the army alone; the delta the war came with has the casualties,
+// and results can arrive after later deltas have changed the army again.
+func (gs *GameState) HandleWar(r WarResult) (WarOutcome, error) {
+	defer fmt.Println("------------------------")
+	fmt.Println()
+	fmt.Println("==== War Declared ====")
+	fmt.Printf("%s has declared war on %s in %s!\n", r.War.Attacker.Username, r.War.Defender.Username, r.War.Location)
+
+	username := gs.GetUsername()
+	if username != r.War.Attacker.Username && username != r.War.Defender.Username {
+		fmt.Printf("%s, you are not involved in this war.\n", username)
+		return WarOutcomeNotInvolved, nil
+	}
+	if err := gs.Scenario.CheckWar(r); err != nil {
+		fmt.Println("Error! The war result doesn't add up.")
+		return WarOutcomeNotInvolved, err
+	}
+
+	for _, side := range []Player{r.War.Attacker, r.War.Defender} {
+		fmt.Printf("%s's units:\n", side.Username)
+		for _, unit := range unitsIn(side, r.War.Location) {
+			fmt.Printf("  * %v\n", unit.Rank)
+		}
+	}
+	fmt.Printf("Attacker has a power level of %v\n", r.AttackerPower)
+	fmt.Printf("Defender has a power level of %v\n", r.DefenderPower)
+	fmt.Printf("The war lasted %d round(s).\n", r.Rounds)
+
+	for _, lost := range r.Casualties {
+		if lost.Username != username {
+			continue
 		}
-		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
-	} else if defenderPower > attackerPower {
-		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
-		if player.Username == rw.Attacker.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
+		if len(lost.Killed) > 0 {
+			fmt.Printf("You lost %d unit(s) in %s.\n", len(lost.Killed), r.War.Location)
 		}
-		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
+		for _, u := range lost.Wounded {
+			fmt.Printf("Your %s %v was wounded and has %d hit point(s) left.\n", u.Rank, u.ID, u.HP)
+		}
+	}
+	switch r.Winner {
+	case "":
+		fmt.Println("The war ended in a draw!")
+		return WarOutcomeDraw, nil
+	case username:
+		fmt.Println("You have won the war!")
+		return WarOutcomeYouWon, nil
+	default:
+		fmt.Println("You have lost the war!")
+		return WarOutcomeOpponentWon, nil
 	}
-	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-	gs.removeUnitsInLocation(overlappingLocation)
-	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
 }
 
-func unitsToPowerLevel(units []Unit) int {
-	power := 0
-	for _, unit := range units {
-		if unit.Rank == RankArtillery {
-			power += 10
-		}
-		if unit.Rank == RankCavalry {
-			power += 5
+func unitsIn(p Player, l Location) []Unit {
+	units := []Unit{}
+	for _, unit := range p.Units {
+		if unit.Location == l {
+			units = append(units, unit)
 		}
-		if unit.Rank == RankInfantry {
-			power += 1
+	}
+	return units
+}
+
+// armyIn returns p with only its units in l, which is all of its army a war
+// there needs.
+func armyIn(p Player, l Location) Player {
+	army := Player{Username: p.Username, Units: map[int]Unit{}}
+	for _, unit := range unitsIn(p, l) {
+		army.Units[unit.ID] = unit
+	}
+	return army
+}
+
+// occupied returns the territories p has units in, in name order.
+func occupied(p Player) []Location {
+	seen := map[Location]bool{}
+	var ls []Location
+	for _, unit := range p.Units {
+		if !seen[unit.Location] {
+			seen[unit.Location] = true
+			ls = append(ls, unit.Location)
 		}
 	}
-	return power
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	return ls
 }
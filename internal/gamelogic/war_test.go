@@ -0,0 +1,60 @@
+package gamelogic
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHandleWar(t *testing.T) {
+	s := DefaultScenario()
+	rw := RecognitionOfWar{
+		Attacker: army("alice", []Unit{{ID: 1, Rank: RankCavalry}, {ID: 2, Rank: RankInfantry}}),
+		Defender: army("bob", []Unit{{ID: 1, Rank: RankInfantry}}),
+		Location: "europe",
+		Seed:     7,
+	}
+	genuine, ok := s.Fight(rw)
+	if !ok {
+		t.Fatal("no war was fought")
+	}
+	if len(genuine.Casualties) == 0 {
+		t.Fatal("the war has no casualties to tamper with")
+	}
+	tests := []struct {
+		name     string
+		username string
+		tamper   func(*WarResult)
+		want     WarOutcome
+		wantErr  error
+	}{
+		{name: "genuine", username: "bob", tamper: func(*WarResult) {}, want: outcomeFor("bob", genuine)},
+		{name: "someone else's war", username: "carol", tamper: func(*WarResult) {}, want: WarOutcomeNotInvolved},
+		{name: "attacker power", username: "bob", tamper: func(r *WarResult) { r.AttackerPower = 0 }, wantErr: ErrBadWarResult},
+		{name: "casualties", username: "bob", tamper: func(r *WarResult) { r.Casualties = r.Casualties[1:] }, wantErr: ErrBadWarResult},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := NewGameState(tt.username, s)
+			r, _ := s.Fight(rw)
+			tt.tamper(&r)
+			outcome, err := gs.HandleWar(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("HandleWar error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && outcome != tt.want {
+				t.Errorf("outcome = %v, want %v", outcome, tt.want)
+			}
+		})
+	}
+}
+
+func outcomeFor(username string, r WarResult) WarOutcome {
+	switch r.Winner {
+	case "":
+		return WarOutcomeDraw
+	case username:
+		return WarOutcomeYouWon
+	default:
+		return WarOutcomeOpponentWon
+	}
+}
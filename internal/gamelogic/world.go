@@ -0,0 +1,292 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// ErrNotJoined is returned for intents from players who haven't joined.
+var ErrNotJoined = errors.New("you have not joined the game")
+
+// ErrGameOver is returned for intents sent once someone has won.
+var ErrGameOver = errors.New("the game is over")
+
+// SpawnIntent asks the server to spawn a unit for the player sending it.
+type SpawnIntent struct {
+	Location Location
+	Rank     UnitRank
+}
+
+// MoveIntent asks the server to move some of the sending player's units.
+type MoveIntent struct {
+	Units      []UnitRef
+	ToLocation Location
+}
+
+// StateDelta is a change the server made to the world. It goes to every
+// player and has every army the change touched, including what wars did to
+// them, so all views of the world agree. Deltas are numbered in the order
+// they were made, so a view that sees a gap knows it has missed one.
+type StateDelta struct {
+	Seq     uint64
+	Players []PlayerDelta
+	// Events describe what happened, for people.
+	Events []string
+	// Winner is set by the change that won the game.
+	Winner string
+}
+
+// PlayerDelta is how a change affected one player's army.
+type PlayerDelta struct {
+	Username string
+	// Updated are units added, moved or wounded, Removed the IDs of units killed.
+	Updated []Unit
+	Removed []int
+	// Spent is the cost of every unit the player has spawned.
+	Spent int
+}
+
+// WorldSnapshot is the whole world as of delta Seq.
+type WorldSnapshot struct {
+	Seq     uint64
+	Players []Player
+	Spent   map[string]int
+	// Winner is who won the game, if it is over.
+	Winner string
+}
+
+// World is the authoritative state of a game, kept by the server. Players
+// send it intents, which it checks against the scenario and carries out,
+// fighting any wars that follow, and describes what changed as deltas.
+type World struct {
+	scenario *Scenario
+
+	mu      sync.Mutex
+	seq     uint64
+	players map[string]*Player
+	spent   map[string]int
+	// joined orders players by when they joined, so wars with several
+	// defenders are fought in a fixed order.
+	joined []string
+	// lastID is the last unit ID given to each player. IDs only go up, so
+	// a unit spawned after another dies never takes its ID.
+	lastID map[string]int
+	// winner is the first player to meet a victory condition. Once there
+	// is one, the world doesn't change any more.
+	winner string
+}
+
+func NewWorld(scenario *Scenario) *World {
+	return &World{
+		scenario: scenario,
+		players:  map[string]*Player{},
+		spent:    map[string]int{},
+		lastID:   map[string]int{},
+	}
+}
+
+// Snapshot returns the whole world.
+func (w *World) Snapshot() WorldSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshot()
+}
+
+func (w *World) snapshot() WorldSnapshot {
+	snap := WorldSnapshot{Seq: w.seq, Spent: map[string]int{}, Winner: w.winner}
+	for _, name := range w.joined {
+		snap.Players = append(snap.Players, copyPlayer(*w.players[name]))
+		snap.Spent[name] = w.spent[name]
+	}
+	return snap
+}
+
+// Join adds username to the game with the army the scenario gives them. It
+// returns the world as the player now finds it, and the delta adding them if
+// they weren't already playing.
+func (w *World) Join(username string) (WorldSnapshot, *StateDelta) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.players[username]; ok {
+		return w.snapshot(), nil
+	}
+	p := &Player{Username: username, Units: map[int]Unit{}}
+	w.players[username] = p
+	w.joined = append(w.joined, username)
+
+	change := PlayerDelta{Username: username}
+	for _, start := range w.scenario.StartingArmy(username) {
+		for i := 0; i < start.Count; i++ {
+			unit := Unit{ID: w.nextID(username), Owner: username, Rank: start.Rank, Location: start.Location, HP: w.scenario.ranks[start.Rank].HP}
+			p.Units[unit.ID] = unit
+			change.Updated = append(change.Updated, unit)
+		}
+	}
+	d := w.commit([]PlayerDelta{change}, fmt.Sprintf("%s joined the game with %d unit(s)", username, len(p.Units)))
+	return w.snapshot(), &d
+}
+
+// Spawn carries out a player's spawn intent.
+func (w *World) Spawn(username string, intent SpawnIntent) (StateDelta, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.players[username]
+	if !ok {
+		return StateDelta{}, ErrNotJoined
+	}
+	if w.winner != "" {
+		return StateDelta{}, ErrGameOver
+	}
+	if !w.scenario.Map().Has(intent.Location) {
+		return StateDelta{}, fmt.Errorf("%s is not a valid location", intent.Location)
+	}
+	spec, ok := w.scenario.Rank(intent.Rank)
+	if !ok {
+		return StateDelta{}, fmt.Errorf("%s is not a valid unit", intent.Rank)
+	}
+	if budget := w.scenario.SpawnBudget; budget > 0 && w.spent[username]+spec.Cost > budget {
+		return StateDelta{}, fmt.Errorf("a(n) %s costs %d, more than the %d left of your budget", intent.Rank, spec.Cost, budget-w.spent[username])
+	}
+
+	w.spent[username] += spec.Cost
+	unit := Unit{ID: w.nextID(username), Owner: username, Rank: intent.Rank, Location: intent.Location, HP: spec.HP}
+	p.Units[unit.ID] = unit
+	return w.commit([]PlayerDelta{{Username: username, Updated: []Unit{unit}}},
+		fmt.Sprintf("%s spawned a(n) %s in %s with id %v", username, unit.Rank, unit.Location, unit.ID)), nil
+}
+
+// Move carries out a player's move intent, then fights a war with each
+// player who has units where the army arrives. The delta has the armies as
+// the wars left them, for everyone; the war results, with the dice and
+// rounds that decided each war, are for the belligerents to check.
+func (w *World) Move(username string, intent MoveIntent) (StateDelta, []WarResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.players[username]
+	if !ok {
+		return StateDelta{}, nil, ErrNotJoined
+	}
+	if w.winner != "" {
+		return StateDelta{}, nil, ErrGameOver
+	}
+	if !w.scenario.Map().Has(intent.ToLocation) {
+		return StateDelta{}, nil, fmt.Errorf("%s is not a valid location", intent.ToLocation)
+	}
+	if len(intent.Units) == 0 {
+		return StateDelta{}, nil, errors.New("no units to move")
+	}
+	// Check every unit can make it before moving any.
+	var moved []Unit
+	for _, ref := range intent.Units {
+		if ref.Owner != username {
+			return StateDelta{}, nil, fmt.Errorf("unit %s is not yours to move", ref)
+		}
+		unit, ok := p.Units[ref.ID]
+		if !ok {
+			return StateDelta{}, nil, fmt.Errorf("unit %s not found", ref)
+		}
+		if _, err := w.scenario.Route(unit, intent.ToLocation); err != nil {
+			return StateDelta{}, nil, err
+		}
+		moved = append(moved, unit)
+	}
+
+	changes := map[string]*PlayerDelta{username: {Username: username}}
+	for _, unit := range moved {
+		unit.Location = intent.ToLocation
+		p.Units[unit.ID] = unit
+		changes[username].Updated = append(changes[username].Updated, unit)
+	}
+	events := []string{fmt.Sprintf("%s moved %v unit(s) to %s", username, len(moved), intent.ToLocation)}
+	var wars []WarResult
+
+	for _, name := range w.joined {
+		if name == username {
+			continue
+		}
+		war := RecognitionOfWar{
+			Attacker: armyIn(*p, intent.ToLocation),
+			Defender: armyIn(*w.players[name], intent.ToLocation),
+			Location: intent.ToLocation,
+			Seed:     rand.Int63(),
+		}
+		result, ok := w.scenario.Fight(war)
+		if !ok {
+			continue
+		}
+		wars = append(wars, result)
+		events = append(events, fmt.Sprintf("%s went to war with %s in %s", username, name, intent.ToLocation))
+		for _, casualty := range result.Casualties {
+			if changes[casualty.Username] == nil {
+				changes[casualty.Username] = &PlayerDelta{Username: casualty.Username}
+			}
+			for _, ref := range casualty.Killed {
+				delete(w.players[casualty.Username].Units, ref.ID)
+				changes[casualty.Username].Removed = append(changes[casualty.Username].Removed, ref.ID)
+			}
+			for _, u := range casualty.Wounded {
+				w.players[casualty.Username].Units[u.ID] = u
+				changes[casualty.Username].Updated = append(changes[casualty.Username].Updated, u)
+			}
+		}
+		// An army beaten in one war can't fight the next.
+		if len(unitsIn(*p, intent.ToLocation)) == 0 {
+			break
+		}
+	}
+
+	var players []PlayerDelta
+	for _, name := range w.joined {
+		if c, ok := changes[name]; ok {
+			players = append(players, *c)
+		}
+	}
+	return w.commit(players, events...), wars, nil
+}
+
+// contenders are the players who have had units. Players who haven't yet
+// aren't beaten, only not playing, so they don't stop anyone being the last
+// one standing.
+func (w *World) contenders() []Player {
+	var players []Player
+	for _, name := range w.joined {
+		if w.lastID[name] > 0 {
+			players = append(players, *w.players[name])
+		}
+	}
+	return players
+}
+
+// nextID gives username's next unit its ID.
+func (w *World) nextID(username string) int {
+	w.lastID[username]++
+	return w.lastID[username]
+}
+
+// commit numbers a change and fills in each affected player's spending. If
+// the change won someone the game, it says so.
+func (w *World) commit(players []PlayerDelta, events ...string) StateDelta {
+	w.seq++
+	for i := range players {
+		players[i].Spent = w.spent[players[i].Username]
+	}
+	d := StateDelta{Seq: w.seq, Players: players, Events: events}
+	if w.winner == "" {
+		if winner, ok := w.scenario.Winner(w.contenders()); ok {
+			w.winner = winner
+			d.Winner = winner
+			d.Events = append(d.Events, fmt.Sprintf("%s has won the game!", winner))
+		}
+	}
+	return d
+}
+
+func copyPlayer(p Player) Player {
+	units := make(map[int]Unit, len(p.Units))
+	for id, u := range p.Units {
+		units[id] = u
+	}
+	return Player{Username: p.Username, Units: units}
+}
@@ -0,0 +1,334 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// BatchPublisher buffers messages and publishes them together, waiting for
+// the broker to confirm the whole batch at once instead of message by
+// message. It is a Publisher, so Publish and friends can buffer through it.
+//
+// A batch is flushed when it reaches its size limit, when its oldest message
+// has waited maxDelay, or when Flush is called. Errors from automatic
+// flushes are returned by the next PublishWithContext or Flush.
+//
+// Publish counts a message in MetricPublished once it is buffered, so the
+// count includes messages whose flush later fails; those failures reach the
+// caller only as errors.
+type BatchPublisher struct {
+	conn     Connection
+	maxSize  int
+	maxDelay time.Duration
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	ch       Channel
+	confirms chan amqp.Confirmation
+	batch    []batchedPublishing
+	timer    *time.Timer
+	err      error
+}
+
+type batchedPublishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// NewBatchPublisher opens a confirm-mode channel on conn when it first
+// flushes. timeout bounds the wait for a batch's confirms.
+func NewBatchPublisher(conn Connection, maxSize int, maxDelay, timeout time.Duration) *BatchPublisher {
+	return &BatchPublisher{
+		conn:     conn,
+		maxSize:  max(maxSize, 1),
+		maxDelay: maxDelay,
+		timeout:  timeout,
+	}
+}
+
+// PublishWithContext adds msg to the current batch. The mandatory and
+// immediate flags are ignored.
+func (p *BatchPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.takeErr(); err != nil {
+		return err
+	}
+	p.batch = append(p.batch, batchedPublishing{exchange: exchange, key: key, msg: msg})
+	if len(p.batch) >= p.maxSize {
+		return p.flushLocked()
+	}
+	if p.timer == nil && p.maxDelay > 0 {
+		p.timer = time.AfterFunc(p.maxDelay, p.flushLater)
+	}
+	return nil
+}
+
+// Flush publishes everything buffered and waits for it to be confirmed.
+func (p *BatchPublisher) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.flushLocked()
+	return errors.Join(p.takeErr(), err)
+}
+
+// Close flushes what is left and closes the publisher's channel.
+func (p *BatchPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := errors.Join(p.takeErr(), p.flushLocked())
+	p.reset()
+	return err
+}
+
+func (p *BatchPublisher) flushLater() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timer = nil
+	if err := p.flushLocked(); err != nil {
+		p.err = errors.Join(p.err, err)
+	}
+}
+
+func (p *BatchPublisher) takeErr() error {
+	err := p.err
+	p.err = nil
+	return err
+}
+
+func (p *BatchPublisher) flushLocked() error {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	batch := p.batch
+	p.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := p.open(); err != nil {
+		return fmt.Errorf("pubsub: flushing %d messages: %w", len(batch), err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	for i, b := range batch {
+		if err := p.ch.PublishWithContext(ctx, b.exchange, b.key, false, false, b.msg); err != nil {
+			p.reset()
+			return fmt.Errorf("pubsub: flushing %d messages, %d published: %w", len(batch), i, err)
+		}
+	}
+
+	nacked := 0
+	for range batch {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				p.reset()
+				return fmt.Errorf("pubsub: flushing %d messages: %w", len(batch), amqp.ErrClosed)
+			}
+			if !confirm.Ack {
+				nacked++
+			}
+		case <-ctx.Done():
+			// Late confirms would be mistaken for the next batch's.
+			p.reset()
+			return fmt.Errorf("pubsub: waiting for batch confirms: %w", ctx.Err())
+		}
+	}
+	if nacked > 0 {
+		return fmt.Errorf("%w: %d of %d messages in batch", ErrNacked, nacked, len(batch))
+	}
+	return nil
+}
+
+func (p *BatchPublisher) open() error {
+	if p.ch != nil {
+		return nil
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, p.maxSize))
+	return nil
+}
+
+func (p *BatchPublisher) reset() {
+	if p.ch == nil {
+		return
+	}
+	p.ch.Close()
+	p.ch = nil
+	p.confirms = nil
+}
+
+// SubscribeBatch is SubscribeMessage for handlers that take messages in
+// batches of up to size, or whatever has arrived once the first message of a
+// batch has waited maxWait (a second if it is not positive). The handler's verdict applies to the whole
+// batch, which is settled with a single multiple acknowledgement.
+//
+// Batches are handled one at a time; WithWorkers, WithOrderingKey, WithRetry
+// and WithDedup do not apply to them. The prefetch count is raised to size if
+// it is smaller. Middleware screens each message as it joins a batch, which
+// suits checks like Authorize and Verify: a message it doesn't pass on is
+// settled on its own and left out.
+func SubscribeBatch[T any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
+	exchange,
+	queueName,
+	key string,
+	queueOpts QueueOptions,
+	size int,
+	maxWait time.Duration,
+	handler func(context.Context, []Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	size = max(size, 1)
+	if maxWait <= 0 {
+		maxWait = time.Second
+	}
+	opts = append(opts, func(o *subscribeOptions) {
+		o.workers = 1
+		o.prefetch = max(o.prefetch, size)
+	})
+	sub := newSubscription(queueName, newSubscribeOptions(opts))
+	b := &batcher[T]{
+		queue:   queueName,
+		size:    size,
+		maxWait: maxWait,
+		handler: handler,
+		logger:  sub.opts.logger.With("queue", queueName),
+		metrics: sub.opts.metrics,
+	}
+	sub.flush = b.flush
+	admit := chain(func(ctx context.Context, d *Delivery) AckType {
+		b.add(d.Raw, Message[T]{Envelope: d.Envelope, Body: d.Body.(T)})
+		return Ack
+	}, append([]Middleware{Recover(sub.opts.logger)}, sub.opts.middleware...))
+	decodeWith(sub, codec, func(ch Channel, msg amqp.Delivery, envelope Envelope, data T) (string, func()) {
+		return "", func() {
+			ackType := admit(context.Background(), &Delivery{Envelope: envelope, Queue: queueName, Body: data, Raw: msg})
+			if ackType != Ack {
+				settle(ch, msg, ackType, nil, b.logger.With("routing_key", msg.RoutingKey, "message_id", envelope.ID), b.metrics, queueName)
+			}
+		}
+	})
+	if err := sub.run(ctx, conn, exchange, key, queueOpts); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// batcher collects deliveries into batches for a batch handler.
+type batcher[T any] struct {
+	queue   string
+	size    int
+	maxWait time.Duration
+	handler func(context.Context, []Message[T]) AckType
+	logger  *slog.Logger
+	metrics *Metrics
+
+	mu         sync.Mutex
+	deliveries []amqp.Delivery
+	messages   []Message[T]
+	timer      *time.Timer
+	// generation tells a timer whether the batch it was started for has
+	// already been flushed.
+	generation int
+}
+
+func (b *batcher[T]) add(d amqp.Delivery, msg Message[T]) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deliveries = append(b.deliveries, d)
+	b.messages = append(b.messages, msg)
+	if len(b.messages) >= b.size {
+		b.flushLocked()
+		return
+	}
+	if len(b.messages) == 1 {
+		generation := b.generation
+		b.timer = time.AfterFunc(b.maxWait, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.generation == generation {
+				b.flushLocked()
+			}
+		})
+	}
+}
+
+func (b *batcher[T]) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher[T]) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.generation++
+	deliveries, messages := b.deliveries, b.messages
+	b.deliveries, b.messages = nil, nil
+	if len(messages) == 0 {
+		return
+	}
+
+	ctx, span := startBatchSpan(b.queue, deliveries)
+	start := time.Now()
+	ackType := b.handle(ctx, messages)
+	b.metrics.observe(b.queue, time.Since(start))
+	endConsumeSpan(span, ackType)
+
+	// Every earlier delivery on the channel belongs to this batch, so
+	// settling the last one with multiple set settles them all.
+	last := deliveries[len(deliveries)-1]
+	n := len(deliveries)
+	var err error
+	switch ackType {
+	case Ack:
+		b.metrics.add(MetricAcked, b.queue, n)
+		err = last.Ack(true)
+	case NackRequeue:
+		b.metrics.add(MetricNackedRequeue, b.queue, n)
+		err = last.Nack(true, true)
+	default:
+		b.metrics.add(MetricNackedDiscard, b.queue, n)
+		err = last.Nack(true, false)
+	}
+	if err != nil {
+		b.logger.Warn("could not settle batch", "size", n, "ack", ackType.String(), "error", err)
+		return
+	}
+	b.logger.Debug("settled batch", "size", n, "ack", ackType.String())
+}
+
+// handle runs the handler, discarding the batch if it panics.
+func (b *batcher[T]) handle(ctx context.Context, messages []Message[T]) (ack AckType) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Error("batch handler panicked, discarding batch",
+				"size", len(messages), "panic", r, "stack", string(debug.Stack()))
+			ack = NackDiscard
+		}
+	}()
+	return b.handler(ctx, messages)
+}
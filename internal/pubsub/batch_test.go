@@ -0,0 +1,186 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// logQueue declares a topic exchange with a queue, logs, bound to it.
+func logQueue(t *testing.T, ch Channel) {
+	t.Helper()
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("logs", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("logs", "logs.*", "peril_topic", false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ready(t *testing.T, ch Channel, queue string) int {
+	t.Helper()
+	q, err := ch.QueueDeclare(queue, true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.Messages
+}
+
+func TestBatchPublisherFlushesWhenFull(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	logQueue(t, ch)
+
+	p := NewBatchPublisher(conn, 3, time.Minute, time.Second)
+	defer p.Close()
+	for i := 0; i < 2; i++ {
+		if err := PublishJSON(p, "peril_topic", "logs.alice", "log"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ready(t, ch, "logs"); n != 0 {
+		t.Fatalf("%d message(s) published before the batch was full", n)
+	}
+	// The publish that fills the batch flushes it and waits for the confirms.
+	if err := PublishJSON(p, "peril_topic", "logs.alice", "log"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ready(t, ch, "logs"); n != 3 {
+		t.Errorf("%d message(s) published once the batch was full, want 3", n)
+	}
+}
+
+func TestBatchPublisherFlushesAfterDelay(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	logQueue(t, ch)
+
+	p := NewBatchPublisher(conn, 100, 20*time.Millisecond, time.Second)
+	defer p.Close()
+	if err := PublishJSON(p, "peril_topic", "logs.alice", "log"); err != nil {
+		t.Fatal(err)
+	}
+	if n := ready(t, ch, "logs"); n != 0 {
+		t.Fatalf("%d message(s) published straight away", n)
+	}
+	getEventually(t, ch, "logs")
+	if err := p.Flush(); err != nil {
+		t.Errorf("Flush after the timed flush = %v", err)
+	}
+}
+
+// TestBatchPublisherConfirmTimeout flushes on a channel whose confirms never
+// come. MetricPublished counts messages as they are buffered, so it counts
+// this one even though the broker never confirmed it.
+func TestBatchPublisherConfirmTimeout(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	logQueue(t, ch)
+
+	p := NewBatchPublisher(unconfirmed{conn}, 10, time.Minute, 20*time.Millisecond)
+	defer p.Close()
+	m := NewMetrics()
+	if err := PublishJSON(p, "peril_topic", "logs.alice", "log", WithPublishMetrics(m)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush = %v, want a deadline exceeded", err)
+	}
+	snap := m.Snapshot()
+	if got := snap.Counter(MetricPublished, "peril_topic"); got != 1 {
+		t.Errorf("%s = %d, want the buffered message counted", MetricPublished, got)
+	}
+	if got := snap.Counter(MetricPublishErrors, "peril_topic"); got != 0 {
+		t.Errorf("%s = %d, want the failed flush left out", MetricPublishErrors, got)
+	}
+}
+
+// unconfirmed is a connection whose channels never confirm publishes.
+type unconfirmed struct{ Connection }
+
+func (c unconfirmed) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return unconfirmedChannel{ch}, nil
+}
+
+type unconfirmedChannel struct{ Channel }
+
+func (unconfirmedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	return confirm
+}
+
+func TestSubscribeBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	logQueue(t, ch)
+
+	batches := make(chan []string, 4)
+	m := NewMetrics()
+	// The middleware turns away bad messages, which are settled on their
+	// own while the rest of the batch is acked together.
+	screen := func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) AckType {
+			if d.Body.(string) == "bad" {
+				return NackDiscard
+			}
+			return next(ctx, d)
+		}
+	}
+	sub, err := SubscribeBatch(ctx, conn, JSON, "peril_topic", "logs", "logs.*", QueueOptions{Durable: true}, 3, time.Minute,
+		func(_ context.Context, msgs []Message[string]) AckType {
+			var bodies []string
+			for _, msg := range msgs {
+				bodies = append(bodies, msg.Body)
+			}
+			batches <- bodies
+			return Ack
+		},
+		WithMiddleware(screen),
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"a", "bad", "b", "c"} {
+		if err := PublishJSON(ch, "peril_topic", "logs.alice", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-batches:
+		if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+			t.Errorf("got batch %q, want [a b c]", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no batch")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && m.Snapshot().Counter(MetricAcked, "logs") < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sub.Close()
+	snap := m.Snapshot()
+	if got := snap.Counter(MetricAcked, "logs"); got != 3 {
+		t.Errorf("%s = %d, want 3", MetricAcked, got)
+	}
+	if got := snap.Counter(MetricNackedDiscard, "logs"); got != 1 {
+		t.Errorf("%s = %d, want 1", MetricNackedDiscard, got)
+	}
+	// Once the subscription has gone, anything left unsettled would be
+	// back in the queue.
+	if n := ready(t, ch, "logs"); n != 0 {
+		t.Errorf("%d message(s) left in the queue, want every one settled", n)
+	}
+}
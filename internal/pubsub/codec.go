@@ -0,0 +1,133 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec serializes message bodies for one AMQP content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	Gob      Codec = gobCodec{}
+	MsgPack  Codec = msgPackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{
+	byType: map[string]Codec{},
+}
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Gob)
+	RegisterCodec(MsgPack)
+	RegisterCodec(Protobuf)
+	registerCodecAlias("application/x-msgpack", MsgPack)
+	registerCodecAlias("application/x-protobuf", Protobuf)
+}
+
+// RegisterCodec makes c available to subscribers for messages with its
+// content type, replacing any codec already registered for it.
+func RegisterCodec(c Codec) {
+	registerCodecAlias(c.ContentType(), c)
+}
+
+func registerCodecAlias(contentType string, c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[contentType] = c
+}
+
+// CodecFor looks up the codec for an AMQP content type. Parameters such as
+// "; charset=utf-8" are ignored.
+func CodecFor(contentType string) (Codec, bool) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[contentType]
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgPackCodec struct{}
+
+func (msgPackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgPackCodec) Marshal(v any) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgPackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+// protobufCodec only handles generated protobuf messages. Subscribing with a
+// pointer message type such as *pb.GameLog works too: the codec allocates the
+// message before decoding into it.
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/protobuf" }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() == reflect.Pointer && ptr.Elem().Kind() == reflect.Pointer {
+		msg := reflect.New(ptr.Elem().Type().Elem())
+		if m, ok := msg.Interface().(proto.Message); ok {
+			if err := proto.Unmarshal(data, m); err != nil {
+				return err
+			}
+			ptr.Elem().Set(msg)
+			return nil
+		}
+	}
+	return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+}
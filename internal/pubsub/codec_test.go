@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecMove struct {
+	Player string
+	Units  []int
+	To     string
+}
+
+// roundTrip publishes val with codec and decodes what arrives, by its
+// content type, as a T.
+func roundTrip[T any](t *testing.T, codec Codec, val T) T {
+	t.Helper()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	movesQueue(t, ch)
+	if err := Publish(ch, codec, "peril_topic", "moves.alice", val); err != nil {
+		t.Fatal(err)
+	}
+	d := getEventually(t, ch, "moves")
+	if d.ContentType != codec.ContentType() {
+		t.Errorf("published with content type %q, want %q", d.ContentType, codec.ContentType())
+	}
+	// The fallback is never needed for a message that says what it is.
+	got, err := decode[T](d, JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	move := codecMove{Player: "alice", Units: []int{1, 2}, To: "europe"}
+	for _, codec := range []Codec{JSON, Gob, MsgPack} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			if got := roundTrip(t, codec, move); !reflect.DeepEqual(got, move) {
+				t.Errorf("got %+v, want %+v", got, move)
+			}
+		})
+	}
+
+	t.Run(Protobuf.ContentType(), func(t *testing.T) {
+		// Subscribers take generated messages by pointer.
+		got := roundTrip(t, Protobuf, wrapperspb.String("alice moves to europe"))
+		if got.GetValue() != "alice moves to europe" {
+			t.Errorf("got %q", got.GetValue())
+		}
+	})
+}
+
+func TestProtobufNeedsMessages(t *testing.T) {
+	if _, err := Protobuf.Marshal(codecMove{}); err == nil {
+		t.Error("marshalled a struct that isn't a proto.Message")
+	}
+	data, err := proto.Marshal(wrapperspb.String("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var move codecMove
+	if err := Protobuf.Unmarshal(data, &move); err == nil {
+		t.Error("unmarshalled into a struct that isn't a proto.Message")
+	}
+}
+
+func TestDecodeContentType(t *testing.T) {
+	body := []byte(`{"Player":"alice","To":"europe"}`)
+	want := codecMove{Player: "alice", To: "europe"}
+	tests := []struct {
+		name        string
+		contentType string
+		err         string
+	}{
+		{"registered", "application/json", ""},
+		{"with parameters", "application/json; charset=utf-8", ""},
+		{"none, so the fallback", "", ""},
+		{"not registered", "application/xml", `no codec registered for content type "application/xml"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode[codecMove](amqp.Delivery{ContentType: tt.contentType, Body: body}, JSON)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
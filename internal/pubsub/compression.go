@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultMaxMessageSize is the largest body, after compression, that
+// PublishContext sends unless WithMaxMessageSize says otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrMessageTooLarge means a message was refused before publishing because
+// its body exceeded the size limit. The error returned is a
+// *MessageTooLargeError.
+var ErrMessageTooLarge = errors.New("pubsub: message too large")
+
+type MessageTooLargeError struct {
+	Exchange   string
+	RoutingKey string
+	Size       int
+	Limit      int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("pubsub: message to exchange %q with key %q is %d bytes, over the limit of %d", e.Exchange, e.RoutingKey, e.Size, e.Limit)
+}
+
+func (e *MessageTooLargeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// Compression compresses message bodies for one AMQP content encoding.
+type Compression interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	Gzip Compression = gzipCompression{}
+	Zstd Compression = &zstdCompression{}
+)
+
+var compressions = struct {
+	sync.RWMutex
+	byEncoding map[string]Compression
+}{
+	byEncoding: map[string]Compression{},
+}
+
+func init() {
+	RegisterCompression(Gzip)
+	RegisterCompression(Zstd)
+}
+
+// RegisterCompression makes c available to subscribers for messages with its
+// content encoding, replacing any compression already registered for it.
+func RegisterCompression(c Compression) {
+	compressions.Lock()
+	defer compressions.Unlock()
+	compressions.byEncoding[c.Encoding()] = c
+}
+
+// CompressionFor looks up the compression for an AMQP content encoding.
+func CompressionFor(encoding string) (Compression, bool) {
+	compressions.RLock()
+	defer compressions.RUnlock()
+	c, ok := compressions.byEncoding[encoding]
+	return c, ok
+}
+
+// WithCompression compresses the message body with c, setting its content
+// encoding so subscribers decompress it transparently. Bodies that would not
+// get any smaller are sent as they are.
+func WithCompression(c Compression) PublishOption {
+	return func(o *publishOptions) {
+		o.compression = c
+	}
+}
+
+// WithMaxMessageSize changes the largest body, after compression, that may be
+// published. A limit of zero or less lifts it altogether.
+func WithMaxMessageSize(n int) PublishOption {
+	return func(o *publishOptions) {
+		o.maxSize = n
+	}
+}
+
+// compress compresses the body of msg with c if that makes it smaller.
+func compress(msg *amqp.Publishing, c Compression) error {
+	compressed, err := c.Compress(msg.Body)
+	if err != nil {
+		return fmt.Errorf("pubsub: compressing with %s: %w", c.Encoding(), err)
+	}
+	if len(compressed) < len(msg.Body) {
+		msg.Body = compressed
+		msg.ContentEncoding = c.Encoding()
+	}
+	return nil
+}
+
+// decompress undoes a message body's content encoding.
+func decompress(body []byte, encoding string) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	c, ok := CompressionFor(encoding)
+	if !ok {
+		return nil, fmt.Errorf("no compression registered for content encoding %q", encoding)
+	}
+	return c.Decompress(body)
+}
+
+type gzipCompression struct{}
+
+func (gzipCompression) Encoding() string { return "gzip" }
+
+func (gzipCompression) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompression) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// zstdCompression shares one encoder and one decoder, which are safe for
+// concurrent use through EncodeAll and DecodeAll.
+type zstdCompression struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (*zstdCompression) Encoding() string { return "zstd" }
+
+func (z *zstdCompression) init() error {
+	z.once.Do(func() {
+		z.encoder, z.err = zstd.NewWriter(nil)
+		if z.err != nil {
+			return
+		}
+		z.decoder, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCompression) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompression) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.decoder.DecodeAll(data, nil)
+}
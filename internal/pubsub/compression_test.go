@@ -0,0 +1,133 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// movesQueue declares a topic exchange with a queue, moves, bound to it.
+func movesQueue(t *testing.T, ch Channel) {
+	t.Helper()
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("moves", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("moves", "moves.*", "peril_topic", false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	long := strings.Repeat("alice moves to europe. ", 200)
+	for _, c := range []Compression{Gzip, Zstd} {
+		t.Run(c.Encoding(), func(t *testing.T) {
+			conn := dial(t, NewMemoryBroker())
+			ch := channel(t, conn)
+			movesQueue(t, ch)
+
+			for _, body := range []string{long, "short"} {
+				if err := PublishJSON(ch, "peril_topic", "moves.alice", body, WithCompression(c)); err != nil {
+					t.Fatal(err)
+				}
+				d := getEventually(t, ch, "moves")
+				// Bodies compression wouldn't shrink are sent as they are.
+				wantEncoding := c.Encoding()
+				if body == "short" {
+					wantEncoding = ""
+				}
+				if d.ContentEncoding != wantEncoding {
+					t.Errorf("%d-byte body sent with content encoding %q, want %q", len(body), d.ContentEncoding, wantEncoding)
+				}
+				got, err := Decode[string](d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != body {
+					t.Errorf("got %.20q..., want %.20q...", got, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	movesQueue(t, ch)
+
+	long := strings.Repeat("a", 1000)
+	err := PublishJSON(ch, "peril_topic", "moves.alice", long, WithMaxMessageSize(100))
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v, want a *MessageTooLargeError", err)
+	}
+	want := MessageTooLargeError{Exchange: "peril_topic", RoutingKey: "moves.alice", Size: len(long) + 2, Limit: 100}
+	if *tooLarge != want {
+		t.Errorf("got %+v, want %+v", *tooLarge, want)
+	}
+	if d, ok, _ := ch.Get("moves", true); ok {
+		t.Errorf("%d-byte message was published anyway", len(d.Body))
+	}
+
+	// The limit is on the body as sent, so compression can bring it under.
+	if err := PublishJSON(ch, "peril_topic", "moves.alice", long, WithMaxMessageSize(100), WithCompression(Gzip)); err != nil {
+		t.Errorf("compressed message refused: %v", err)
+	}
+}
+
+func TestUnknownContentEncoding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	movesQueue(t, ch)
+
+	msg := amqp.Publishing{ContentType: "application/json", ContentEncoding: "br", Body: []byte(`"move"`)}
+	if err := ch.PublishWithContext(ctx, "peril_topic", "moves.alice", false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+	d := getEventually(t, ch, "moves")
+	if _, err := Decode[string](d); err == nil || !strings.Contains(err.Error(), `content encoding "br"`) {
+		t.Errorf("Decode = %v, want no compression for br", err)
+	}
+
+	// A subscription discards it without calling the handler.
+	if err := ch.PublishWithContext(ctx, "peril_topic", "moves.alice", false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	handled := make(chan string, 1)
+	sub, err := SubscribeJSON(ctx, conn, "peril_topic", "moves", "moves.*", QueueOptions{Durable: true},
+		func(body string) AckType {
+			handled <- body
+			return Ack
+		},
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	deadline := time.Now().Add(time.Second)
+	for m.Snapshot().Counter(MetricNackedDiscard, "moves") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the message was never discarded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := m.Snapshot().Counter(MetricDecodeFailures, "moves"); got != 1 {
+		t.Errorf("%s = %d, want 1", MetricDecodeFailures, got)
+	}
+	select {
+	case body := <-handled:
+		t.Errorf("handler was given %q", body)
+	default:
+	}
+}
@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrNacked means the broker refused responsibility for a message.
+	ErrNacked = errors.New("pubsub: message was nacked by the broker")
+	// ErrUnroutable means no queue was bound to receive a message. The error
+	// returned is an *UnroutableError.
+	ErrUnroutable = errors.New("pubsub: message could not be routed to any queue")
+)
+
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("pubsub: message to exchange %q with key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+func (e *UnroutableError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+// ConfirmedPublisher publishes on a channel in confirm mode. Every publish is
+// mandatory and waits for the broker's ack, so callers learn about messages
+// that were nacked, unroutable or never confirmed.
+type ConfirmedPublisher struct {
+	conn    Connection
+	timeout time.Duration
+
+	mu       sync.Mutex
+	ch       Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// NewConfirmedPublisher opens channels on conn as needed. timeout bounds the
+// wait for a confirm when the caller's context has no deadline of its own.
+func NewConfirmedPublisher(conn Connection, timeout time.Duration) *ConfirmedPublisher {
+	return &ConfirmedPublisher{
+		conn:    conn,
+		timeout: timeout,
+	}
+}
+
+// PublishWithContext publishes msg and waits for it to be confirmed. The
+// mandatory flag is always set so unroutable messages are reported.
+func (p *ConfirmedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok && p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	if err := p.open(); err != nil {
+		return err
+	}
+	if err := p.ch.PublishWithContext(ctx, exchange, key, true, immediate, msg); err != nil {
+		p.reset()
+		return err
+	}
+
+	select {
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			p.reset()
+			return amqp.ErrClosed
+		}
+		// The broker sends basic.return before the ack for the same message.
+		select {
+		case ret := <-p.returns:
+			return &UnroutableError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}
+		default:
+		}
+		if !confirm.Ack {
+			return ErrNacked
+		}
+		return nil
+	case <-ctx.Done():
+		// A late confirm would be mistaken for the next message's, so the
+		// channel is abandoned.
+		p.reset()
+		return fmt.Errorf("pubsub: waiting for publisher confirm: %w", ctx.Err())
+	}
+}
+
+// Close closes the publisher's channel, if it has one.
+func (p *ConfirmedPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset()
+	return nil
+}
+
+func (p *ConfirmedPublisher) open() error {
+	if p.ch != nil {
+		return nil
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+func (p *ConfirmedPublisher) reset() {
+	if p.ch == nil {
+		return
+	}
+	p.ch.Close()
+	p.ch = nil
+	p.confirms = nil
+	p.returns = nil
+}
@@ -0,0 +1,203 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetter is a message sitting in a dead-letter queue, along with where it
+// was originally headed and why it ended up there.
+type DeadLetter struct {
+	Delivery   amqp.Delivery
+	Exchange   string
+	RoutingKey string
+	Queue      string
+	Reason     string
+	Count      int64
+	Time       time.Time
+}
+
+// ParseDeadLetter reads the origin of d from the x-death header the broker
+// adds when it dead-letters a message, or from the headers a RetryPolicy adds
+// when it gives up on one.
+func ParseDeadLetter(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		Delivery:   d,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+	}
+	if deaths, ok := d.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		// The last entry is the first death, which is where the message was
+		// originally published; later ones come from retry delay queues.
+		if first, ok := deaths[len(deaths)-1].(amqp.Table); ok {
+			dl.Exchange, _ = first["exchange"].(string)
+			dl.Queue, _ = first["queue"].(string)
+			dl.Reason, _ = first["reason"].(string)
+			dl.Time, _ = first["time"].(time.Time)
+			if keys, ok := first["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+		}
+		for _, death := range deaths {
+			if entry, ok := death.(amqp.Table); ok {
+				dl.Count += headerInt(entry, "count")
+			}
+		}
+	}
+	if exchange, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		dl.Exchange = exchange
+		dl.RoutingKey, _ = d.Headers[HeaderOriginalRoutingKey].(string)
+	}
+	if queue, ok := d.Headers[HeaderOriginalQueue].(string); ok {
+		dl.Queue = queue
+	}
+	if reason, ok := d.Headers[HeaderFailureReason].(string); ok {
+		dl.Reason = reason
+		dl.Count = headerInt(d.Headers, HeaderRetryAttempt)
+	}
+	if dl.Time.IsZero() {
+		dl.Time = d.Timestamp
+	}
+	return dl
+}
+
+// Decode decodes the dead letter's body with the codec for its content type,
+// falling back to JSON.
+func Decode[T any](d amqp.Delivery) (T, error) {
+	return decode[T](d, JSON)
+}
+
+// DeadLetterQueue inspects and recovers the messages in a dead-letter queue.
+// AMQP can't peek at a queue, so every operation fetches all messages
+// without acking them and then requeues each one it hasn't removed.
+type DeadLetterQueue struct {
+	conn  Connection
+	queue string
+}
+
+func NewDeadLetterQueue(conn Connection, queue string) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		conn:  conn,
+		queue: queue,
+	}
+}
+
+// replayTimeout bounds the wait for the broker to confirm a replayed message.
+const replayTimeout = 5 * time.Second
+
+// List returns the queue's messages, oldest first.
+func (q *DeadLetterQueue) List() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.each(func(fetched []amqp.Delivery, _ func(int) error) error {
+		for _, d := range fetched {
+			letters = append(letters, ParseDeadLetter(d))
+		}
+		return nil
+	})
+	return letters, err
+}
+
+// Replay republishes the messages at the given positions, counting from 1 as
+// List does, to their original exchange and routing key and removes them from
+// the queue. With no positions every message is replayed. Dead-letter and
+// retry headers are dropped, so a replayed message starts over.
+//
+// Each message is removed as soon as the broker has confirmed its copy, so
+// a failure part way leaves neither lost nor duplicated messages behind. A
+// position the queue doesn't have is an error, and nothing is replayed.
+func (q *DeadLetterQueue) Replay(positions ...int) (int, error) {
+	selected := map[int]bool{}
+	for _, n := range positions {
+		selected[n] = true
+	}
+	pub := NewConfirmedPublisher(q.conn, replayTimeout)
+	defer pub.Close()
+	replayed := 0
+	err := q.each(func(fetched []amqp.Delivery, remove func(int) error) error {
+		for _, n := range positions {
+			if n < 1 || n > len(fetched) {
+				return fmt.Errorf("there is no dead letter %d; the queue has %d", n, len(fetched))
+			}
+		}
+		for i, d := range fetched {
+			if len(selected) > 0 && !selected[i+1] {
+				continue
+			}
+			dl := ParseDeadLetter(d)
+			msg := republish(d)
+			for _, header := range []string{"x-death", HeaderRetryAttempt, HeaderFailureReason, HeaderOriginalExchange, HeaderOriginalRoutingKey, HeaderOriginalQueue} {
+				delete(msg.Headers, header)
+			}
+			if err := pub.PublishWithContext(context.Background(), dl.Exchange, dl.RoutingKey, true, false, msg); err != nil {
+				return fmt.Errorf("replay message %d: %w", i+1, err)
+			}
+			if err := remove(i); err != nil {
+				return fmt.Errorf("replay message %d: replayed, but still in the queue: %w", i+1, err)
+			}
+			replayed++
+		}
+		return nil
+	})
+	return replayed, err
+}
+
+// Purge deletes every message in the queue.
+func (q *DeadLetterQueue) Purge() (int, error) {
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	return ch.QueuePurge(q.queue, false)
+}
+
+// each fetches every message in the queue and passes them to fn, which can
+// remove the i'th with remove(i). Fetched messages are held unacked until fn
+// returns so none is fetched twice; the rest are then requeued.
+func (q *DeadLetterQueue) each(fn func(fetched []amqp.Delivery, remove func(i int) error) error) error {
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return err
+	}
+	// Closing the channel requeues anything still unacked.
+	defer ch.Close()
+
+	var fetched []amqp.Delivery
+	for {
+		d, ok, err := ch.Get(q.queue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		fetched = append(fetched, d)
+		if d.MessageCount == 0 {
+			break
+		}
+	}
+
+	removed := make([]bool, len(fetched))
+	fnErr := fn(fetched, func(i int) error {
+		if err := fetched[i].Ack(false); err != nil {
+			return err
+		}
+		removed[i] = true
+		return nil
+	})
+	// Requeued messages go back to the head of the queue, so settling from
+	// the newest keeps their order.
+	for i := len(fetched) - 1; i >= 0; i-- {
+		if removed[i] {
+			continue
+		}
+		if err := fetched[i].Nack(false, true); err != nil {
+			return errors.Join(fnErr, err)
+		}
+	}
+	return fnErr
+}
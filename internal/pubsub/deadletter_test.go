@@ -0,0 +1,166 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deadLetters rejects each of bodies from the moves queue into peril_dlq.
+func deadLetters(t *testing.T, ch Channel, bodies ...string) {
+	t.Helper()
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare(DeadLetterExchange, "fanout", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("peril_dlq", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("peril_dlq", "", DeadLetterExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("moves", true, false, false, false, amqp.Table{"x-dead-letter-exchange": DeadLetterExchange}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("moves", "moves.*", "peril_topic", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range bodies {
+		if err := PublishJSON(ch, "peril_topic", "moves."+body, body); err != nil {
+			t.Fatal(err)
+		}
+		d, ok, err := ch.Get("moves", false)
+		if err != nil || !ok {
+			t.Fatalf("fetching %s: %v", body, err)
+		}
+		if err := d.Nack(false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listed is the bodies of the dead letters in the queue, in order.
+func listed(t *testing.T, dlq *DeadLetterQueue) string {
+	t.Helper()
+	letters, err := dlq.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, dl := range letters {
+		body, err := Decode[string](dl.Delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	return fmt.Sprint(bodies)
+}
+
+func TestDeadLetterQueueList(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	deadLetters(t, ch, "alice", "bob")
+	dlq := NewDeadLetterQueue(conn, "peril_dlq")
+
+	letters, err := dlq.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("listed %d dead letters, want 2", len(letters))
+	}
+	dl := letters[1]
+	if dl.Exchange != "peril_topic" || dl.RoutingKey != "moves.bob" || dl.Queue != "moves" || dl.Reason != "rejected" || dl.Count != 1 {
+		t.Errorf("got %s/%s from %s (%s, %d time(s)), want peril_topic/moves.bob from moves (rejected, 1 time(s))",
+			dl.Exchange, dl.RoutingKey, dl.Queue, dl.Reason, dl.Count)
+	}
+	// Listing leaves the queue as it was.
+	if got := listed(t, dlq); got != "[alice bob]" {
+		t.Errorf("listed %s again, want [alice bob]", got)
+	}
+}
+
+func TestDeadLetterQueueReplay(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	deadLetters(t, ch, "alice", "bob", "carol")
+	dlq := NewDeadLetterQueue(conn, "peril_dlq")
+
+	n, err := dlq.Replay(2)
+	if err != nil || n != 1 {
+		t.Fatalf("Replay(2) = %d, %v; want 1 replayed", n, err)
+	}
+	d := getEventually(t, ch, "moves")
+	if body, _ := Decode[string](d); body != "bob" || d.RoutingKey != "moves.bob" {
+		t.Errorf("replayed %q to %s, want bob to moves.bob", body, d.RoutingKey)
+	}
+	if _, ok := d.Headers["x-death"]; ok {
+		t.Error("the replayed message kept its x-death header")
+	}
+	if got := listed(t, dlq); got != "[alice carol]" {
+		t.Errorf("left %s, want [alice carol]", got)
+	}
+
+	// Positions the queue doesn't have replay nothing.
+	for _, positions := range [][]int{{3}, {0}, {1, 3}} {
+		if n, err := dlq.Replay(positions...); err == nil || n != 0 {
+			t.Errorf("Replay%v = %d, %v; want an error and nothing replayed", positions, n, err)
+		}
+	}
+	if got := listed(t, dlq); got != "[alice carol]" {
+		t.Errorf("left %s, want [alice carol]", got)
+	}
+
+	n, err = dlq.Replay()
+	if err != nil || n != 2 {
+		t.Fatalf("Replay() = %d, %v; want 2 replayed", n, err)
+	}
+	for _, want := range []string{"alice", "carol"} {
+		if body, _ := Decode[string](getEventually(t, ch, "moves")); body != want {
+			t.Errorf("replayed %q, want %q", body, want)
+		}
+	}
+	if got := listed(t, dlq); got != "[]" {
+		t.Errorf("left %s, want the queue empty", got)
+	}
+}
+
+// TestDeadLetterQueueReplayUnroutable replays messages nothing will take:
+// they must stay in the dead-letter queue rather than be lost.
+func TestDeadLetterQueueReplayUnroutable(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	deadLetters(t, ch, "alice", "bob")
+	if _, err := ch.QueueDelete("moves", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	dlq := NewDeadLetterQueue(conn, "peril_dlq")
+
+	n, err := dlq.Replay()
+	if !errors.Is(err, ErrUnroutable) || n != 0 {
+		t.Errorf("Replay() = %d, %v; want nothing replayed and ErrUnroutable", n, err)
+	}
+	if got := listed(t, dlq); got != "[alice bob]" {
+		t.Errorf("left %s, want [alice bob]", got)
+	}
+}
+
+func TestDeadLetterQueuePurge(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	deadLetters(t, ch, "alice", "bob")
+	dlq := NewDeadLetterQueue(conn, "peril_dlq")
+
+	n, err := dlq.Purge()
+	if err != nil || n != 2 {
+		t.Fatalf("Purge() = %d, %v; want 2 purged", n, err)
+	}
+	if got := listed(t, dlq); got != "[]" {
+		t.Errorf("left %s, want the queue empty", got)
+	}
+}
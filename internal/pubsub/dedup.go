@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DedupStore remembers which messages have been handled. Keys combine the
+// queue name and the message ID, so one store can serve several
+// subscriptions.
+type DedupStore interface {
+	// Seen reports whether key was marked and has not yet expired.
+	Seen(key string) (bool, error)
+	Mark(key string) error
+}
+
+// WithDedup makes redeliveries of messages already handled no-ops: they are
+// acked without reaching the handler. A message counts as handled once its
+// handler acks or discards it; requeued messages are still handled again.
+// Messages without an ID are never deduplicated.
+//
+// Copies of a message are handled one after another even with WithWorkers, so a
+// copy arriving while the first is being handled waits and is then skipped.
+// They are kept apart by message ID, or by ordering key if there is one,
+// which copies share since they have the same body.
+func WithDedup(store DedupStore) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.dedup = store
+	}
+}
+
+func dedupKey(queue, messageID string) string {
+	return queue + "/" + messageID
+}
+
+// MemoryDedupStore keeps the most recently handled message keys in memory,
+// forgetting them after a TTL or when it holds more than its capacity.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently marked first
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (s *MemoryDedupStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(*dedupEntry).expires) {
+		s.order.Remove(el)
+		delete(s.entries, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(s.ttl)
+	if el, ok := s.entries[key]; ok {
+		el.Value.(*dedupEntry).expires = expires
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(&dedupEntry{key: key, expires: expires})
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return nil
+}
+
+var dedupBucket = []byte("handled")
+
+// FileDedupStore keeps handled message keys in a BoltDB file, so
+// redeliveries are recognised across restarts. Expired keys are pruned when
+// the store is opened.
+type FileDedupStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+func NewFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &FileDedupStore{db: db, ttl: ttl}
+	if err := s.prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) Seen(key string) (bool, error) {
+	seen := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(dedupBucket).Get([]byte(key))
+		seen = v != nil && !expired(v)
+		return nil
+	})
+	return seen, err
+}
+
+func (s *FileDedupStore) Mark(key string) error {
+	var expires [8]byte
+	binary.BigEndian.PutUint64(expires[:], uint64(time.Now().Add(s.ttl).UnixNano()))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Put([]byte(key), expires[:])
+	})
+}
+
+func (s *FileDedupStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *FileDedupStore) prune() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(dedupBucket)
+		if err != nil {
+			return err
+		}
+		var stale [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			if expired(v) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func expired(v []byte) bool {
+	return len(v) != 8 || time.Now().UnixNano() > int64(binary.BigEndian.Uint64(v))
+}
@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	s := NewMemoryDedupStore(2, 50*time.Millisecond)
+	mustSeen(t, s, "a", false)
+	for _, key := range []string{"a", "b"} {
+		if err := s.Mark(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSeen(t, s, "a", true)
+	mustSeen(t, s, "b", true)
+
+	// Marking a third key forgets the least recently marked.
+	if err := s.Mark("c"); err != nil {
+		t.Fatal(err)
+	}
+	mustSeen(t, s, "a", false)
+	mustSeen(t, s, "c", true)
+
+	time.Sleep(60 * time.Millisecond)
+	mustSeen(t, s, "c", false)
+}
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	s, err := NewFileDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSeen(t, s, "moves/m1", false)
+	if err := s.Mark("moves/m1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Marks survive reopening, until they expire.
+	s, err = NewFileDedupStore(path, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSeen(t, s, "moves/m1", true)
+	if err := s.Mark("moves/m2"); err != nil {
+		t.Fatal(err)
+	}
+	mustSeen(t, s, "moves/m2", false)
+	s.Close()
+}
+
+// TestDedupWithWorkers delivers copies of one message to a subscription with
+// several workers and checks only one is handled.
+func TestDedupWithWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	handled := 0
+	m := NewMetrics()
+	sub, err := Subscribe(ctx, conn, JSON, "peril_topic", "moves", "moves.*", DurableQueue,
+		func(string) AckType {
+			mu.Lock()
+			handled++
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			return Ack
+		},
+		WithWorkers(4),
+		WithDedup(NewMemoryDedupStore(10, time.Minute)),
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameID := func(o *publishOptions) { o.msg.MessageId = "m1" }
+	const copies = 5
+	for i := 0; i < copies; i++ {
+		if err := PublishJSON(ch, "peril_topic", "moves.alice", "move", sameID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		snap := m.Snapshot()
+		if snap.Counter(MetricAcked, "moves")+snap.Counter(MetricDuplicates, "moves") == copies {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the copies were never all settled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sub.Close()
+	if handled != 1 {
+		t.Errorf("handled %d copies of one message, want 1", handled)
+	}
+}
+
+func mustSeen(t *testing.T, s DedupStore, key string, want bool) {
+	t.Helper()
+	seen, err := s.Seen(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != want {
+		t.Errorf("Seen(%q) = %v, want %v", key, seen, want)
+	}
+}
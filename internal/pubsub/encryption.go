@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderEncryptionKey names the secret key a message body is encrypted with.
+const HeaderEncryptionKey = "x-encryption-key"
+
+// SecretKeys looks up the AES keys messages are encrypted with by name. A
+// Keystore is one.
+type SecretKeys interface {
+	SecretKey(name string) ([]byte, error)
+}
+
+// WithEncryption encrypts the message body with AES-GCM under key, which
+// must be 16, 24 or 32 bytes long, naming it keyName so subscribers know
+// which key to decrypt with. The body is compressed first, if at all.
+func WithEncryption(keyName string, key []byte) PublishOption {
+	return func(o *publishOptions) {
+		o.encryptionKeyName = keyName
+		o.encryptionKey = key
+	}
+}
+
+// WithDecryption decrypts encrypted messages with the keys they name. Without
+// it, or without the key, encrypted messages can't be decoded and are
+// discarded.
+func WithDecryption(keys SecretKeys) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decryption = keys
+	}
+}
+
+func encrypt(msg *amqp.Publishing, keyName string, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("pubsub: encrypting with %s: %w", keyName, err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg.Body)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The message ID is authenticated too, so a ciphertext can't be passed
+	// off as part of another message.
+	msg.Body = aead.Seal(nonce, nonce, msg.Body, []byte(msg.MessageId))
+	msg.Headers[HeaderEncryptionKey] = keyName
+	return nil
+}
+
+// decrypt returns msg with its body decrypted, or msg itself if it isn't
+// encrypted.
+func decrypt(msg amqp.Delivery, keys SecretKeys) (amqp.Delivery, error) {
+	keyName, _ := msg.Headers[HeaderEncryptionKey].(string)
+	if keyName == "" {
+		return msg, nil
+	}
+	if keys == nil {
+		return msg, fmt.Errorf("message is encrypted with %s but there are no keys to decrypt it", keyName)
+	}
+	key, err := keys.SecretKey(keyName)
+	if err != nil {
+		return msg, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return msg, err
+	}
+	if len(msg.Body) < aead.NonceSize() {
+		return msg, errors.New("encrypted body is too short")
+	}
+	nonce, ciphertext := msg.Body[:aead.NonceSize()], msg.Body[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, []byte(msg.MessageId))
+	if err != nil {
+		return msg, fmt.Errorf("decrypting with %s: %w", keyName, err)
+	}
+	msg.Body = body
+	return msg, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderSender        = "x-sender"
+
+	// SchemaVersion is the version stamped on messages unless the publisher
+	// asks for another. Messages published before versions existed are
+	// treated as this version too.
+	SchemaVersion = 1
+)
+
+// Envelope is the metadata the publish path stamps on every message.
+type Envelope struct {
+	ID            string
+	Timestamp     time.Time
+	Sender        string
+	Type          string
+	SchemaVersion int
+	CorrelationID string
+	ReplyTo       string
+	Exchange      string
+	RoutingKey    string
+	Redelivered   bool
+	// StreamOffset is the message's position in the stream it was read
+	// from, or -1 if it didn't come from a stream.
+	StreamOffset int64
+}
+
+// Message is a decoded payload together with its envelope.
+type Message[T any] struct {
+	Envelope
+	Body T
+}
+
+// PublishOption sets envelope fields on a published message or changes how
+// it is published.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	msg               *amqp.Publishing
+	compression       Compression
+	encryptionKeyName string
+	encryptionKey     []byte
+	maxSize           int
+	signer            *Signer
+	metrics           *Metrics
+}
+
+// WithSender records who published the message, normally the player's
+// username.
+func WithSender(username string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Headers[HeaderSender] = username
+	}
+}
+
+// WithSchemaVersion stamps the message with a payload version other than
+// SchemaVersion.
+func WithSchemaVersion(version int) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Headers[HeaderSchemaVersion] = int64(version)
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.CorrelationId = id
+	}
+}
+
+// InResponseTo correlates the message with the one being handled, carrying
+// over its correlation ID so a whole chain of messages shares one, or using
+// its message ID if it starts the chain.
+func InResponseTo(e Envelope) PublishOption {
+	id := e.CorrelationID
+	if id == "" {
+		id = e.ID
+	}
+	return WithCorrelationID(id)
+}
+
+// newEnvelope fills in the envelope of a message carrying val and applies
+// opts to it.
+func newEnvelope(msg *amqp.Publishing, val any, opts []PublishOption) publishOptions {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.MessageId = newMessageID()
+	msg.Timestamp = time.Now().UTC()
+	msg.Type = fmt.Sprintf("%T", val)
+	msg.Headers[HeaderSchemaVersion] = int64(SchemaVersion)
+	o := publishOptions{
+		msg:     msg,
+		maxSize: DefaultMaxMessageSize,
+		metrics: DefaultMetrics,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// seal turns the message body into what is sent: compressed, then
+// encrypted, then checked against the size limit and finally signed.
+func (o *publishOptions) seal(exchange, key string) error {
+	if o.compression != nil {
+		if err := compress(o.msg, o.compression); err != nil {
+			return err
+		}
+	}
+	if o.encryptionKey != nil {
+		if err := encrypt(o.msg, o.encryptionKeyName, o.encryptionKey); err != nil {
+			return err
+		}
+	}
+	if o.maxSize > 0 && len(o.msg.Body) > o.maxSize {
+		return &MessageTooLargeError{
+			Exchange:   exchange,
+			RoutingKey: key,
+			Size:       len(o.msg.Body),
+			Limit:      o.maxSize,
+		}
+	}
+	if o.signer != nil {
+		o.signer.sign(o.msg)
+	}
+	return nil
+}
+
+// ParseEnvelope reads the envelope of a delivery.
+func ParseEnvelope(d amqp.Delivery) Envelope {
+	e := Envelope{
+		ID:            d.MessageId,
+		Timestamp:     d.Timestamp,
+		Type:          d.Type,
+		SchemaVersion: SchemaVersion,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Redelivered:   d.Redelivered,
+		StreamOffset:  -1,
+	}
+	e.Sender, _ = d.Headers[HeaderSender].(string)
+	if _, ok := d.Headers[HeaderStreamOffset]; ok {
+		e.StreamOffset = headerInt(d.Headers, HeaderStreamOffset)
+	}
+	if _, ok := d.Headers[HeaderSchemaVersion]; ok {
+		e.SchemaVersion = int(headerInt(d.Headers, HeaderSchemaVersion))
+	}
+	return e
+}
+
+func newMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,168 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// secretKeySize makes secret keys AES-256 keys.
+const secretKeySize = 32
+
+// Keystore keeps keys as base64 files in a directory: <name>.key holds a
+// sender's Ed25519 private key, <name>.pub its public key and <name>.secret
+// a shared AES key. Keys are provisioned by copying files between keystores;
+// players only need each other's .pub files.
+type Keystore struct {
+	dir string
+
+	mu     sync.Mutex
+	public map[string]ed25519.PublicKey
+	secret map[string][]byte
+}
+
+// OpenKeystore opens the keystore in dir, creating the directory if need be.
+func OpenKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("open keystore: %w", err)
+	}
+	return &Keystore{
+		dir:    dir,
+		public: map[string]ed25519.PublicKey{},
+		secret: map[string][]byte{},
+	}, nil
+}
+
+// Signer returns a signer for name, generating its key pair the first time.
+func (k *Keystore) Signer(name string) (*Signer, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	data, err := k.read(name + ".key")
+	if errors.Is(err, fs.ErrNotExist) {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.write(name+".key", private.Seed(), 0o600); err != nil {
+			return nil, err
+		}
+		if err := k.write(name+".pub", public, 0o644); err != nil {
+			return nil, err
+		}
+		return NewSigner(name, private), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ed25519.SeedSize {
+		return nil, fmt.Errorf("keystore: %s.key is not an Ed25519 key", name)
+	}
+	return NewSigner(name, ed25519.NewKeyFromSeed(data)), nil
+}
+
+// PublicKey returns the key name signs with.
+func (k *Keystore) PublicKey(name string) (ed25519.PublicKey, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.public[name]; ok {
+		return key, nil
+	}
+	data, err := k.read(name + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("keystore: %s.pub is not an Ed25519 public key", name)
+	}
+	key := ed25519.PublicKey(data)
+	k.public[name] = key
+	return key, nil
+}
+
+// SecretKey returns the shared key called name.
+func (k *Keystore) SecretKey(name string) ([]byte, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.secret[name]; ok {
+		return key, nil
+	}
+	data, err := k.read(name + ".secret")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != secretKeySize {
+		return nil, fmt.Errorf("keystore: %s.secret is not a %d-byte key", name, secretKeySize)
+	}
+	k.secret[name] = data
+	return data, nil
+}
+
+// EnsureSecretKey returns the shared key called name, generating it if the
+// keystore doesn't have it yet.
+func (k *Keystore) EnsureSecretKey(name string) ([]byte, error) {
+	key, err := k.SecretKey(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key, err
+	}
+	key = make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := k.write(name+".secret", key, 0o600); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			// Someone else generated it first.
+			return k.SecretKey(name)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *Keystore) read(file string) ([]byte, error) {
+	text, err := os.ReadFile(filepath.Join(k.dir, file))
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %s: %w", file, err)
+	}
+	return data, nil
+}
+
+func (k *Keystore) write(file string, data []byte, perm fs.FileMode) error {
+	text := base64.StdEncoding.EncodeToString(data) + "\n"
+	// O_EXCL keeps two processes from overwriting each other's new key.
+	f, err := os.OpenFile(filepath.Join(k.dir, file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("keystore: %w", err)
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return fmt.Errorf("keystore: %w", err)
+	}
+	return f.Close()
+}
+
+// checkKeyName keeps names, which come from message headers, inside the
+// keystore directory.
+func checkKeyName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("keystore: invalid key name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// ManagedConnection is a Connection that redials with exponential backoff
+// whenever the underlying connection drops. Subscriptions made through it are
+// declared, bound and consumed again on every new connection, and publishing
+// through it always uses a channel on the current connection.
+type ManagedConnection struct {
+	dial func() (Connection, error)
+
+	mu        sync.Mutex
+	conn      Connection
+	pubCh     Channel
+	state     ConnState
+	lastErr   error
+	listeners []chan ConnState
+	closes    []chan *amqp.Error
+
+	// subMu serialises new subscriptions with resubscription after a
+	// reconnect, so a consumer is never started twice on one connection.
+	subMu sync.Mutex
+	subs  []*Subscription
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialManaged connects to the RabbitMQ server at url and keeps reconnecting
+// to it until Close is called.
+func DialManaged(url string) (*ManagedConnection, error) {
+	return NewManagedConnection(func() (Connection, error) {
+		return Dial(url)
+	})
+}
+
+// NewManagedConnection makes the first connection with dial and reuses dial
+// for every reconnect. It fails only if the first attempt fails.
+func NewManagedConnection(dial func() (Connection, error)) (*ManagedConnection, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	m := &ManagedConnection{
+		dial:  dial,
+		conn:  conn,
+		state: StateConnected,
+		done:  make(chan struct{}),
+	}
+	go m.watch(conn)
+	return m, nil
+}
+
+func (m *ManagedConnection) Channel() (Channel, error) {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	return conn.Channel()
+}
+
+// NotifyClose registers a receiver that is closed once the managed
+// connection itself is closed. Dropped connections that are recovered from
+// are reported through NotifyState instead.
+func (m *ManagedConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateClosed {
+		close(receiver)
+		return receiver
+	}
+	m.closes = append(m.closes, receiver)
+	return receiver
+}
+
+func (m *ManagedConnection) Close() error {
+	err := error(amqp.ErrClosed)
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.mu.Lock()
+		conn := m.conn
+		m.setStateLocked(StateClosed, nil)
+		for _, receiver := range m.closes {
+			close(receiver)
+		}
+		m.closes = nil
+		for _, listener := range m.listeners {
+			close(listener)
+		}
+		m.listeners = nil
+		m.mu.Unlock()
+		err = conn.Close()
+
+		// Subscriptions can't be resumed any more, so they are over.
+		m.subMu.Lock()
+		for _, s := range m.subs {
+			s.finish()
+		}
+		m.subs = nil
+		m.subMu.Unlock()
+	})
+	return err
+}
+
+// State reports whether the connection is currently usable.
+func (m *ManagedConnection) State() ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// LastError returns the error that caused the most recent disconnect or
+// failed reconnect attempt.
+func (m *ManagedConnection) LastError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastErr
+}
+
+// NotifyState registers a receiver for connection state changes. Sends never
+// block, so a receiver should be buffered. It is closed when the managed
+// connection is closed.
+func (m *ManagedConnection) NotifyState(receiver chan ConnState) chan ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateClosed {
+		close(receiver)
+		return receiver
+	}
+	m.listeners = append(m.listeners, receiver)
+	return receiver
+}
+
+// PublishWithContext publishes on a channel of the current connection,
+// opening a new one if the previous channel failed or the connection was
+// replaced.
+func (m *ManagedConnection) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateClosed {
+		return amqp.ErrClosed
+	}
+	if m.pubCh == nil {
+		ch, err := m.conn.Channel()
+		if err != nil {
+			return err
+		}
+		m.pubCh = ch
+	}
+	err := m.pubCh.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		m.pubCh.Close()
+		m.pubCh = nil
+	}
+	return err
+}
+
+func (m *ManagedConnection) addSubscription(s *Subscription) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	s.unregister = func() {
+		m.removeSubscription(s)
+	}
+	if err := s.start(conn); err != nil {
+		return err
+	}
+	m.subs = append(m.subs, s)
+	return nil
+}
+
+func (m *ManagedConnection) removeSubscription(s *Subscription) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	for i, other := range m.subs {
+		if other == s {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *ManagedConnection) watch(conn Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		var reason *amqp.Error
+		select {
+		case reason = <-closed:
+		case <-m.done:
+			return
+		}
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+		m.setState(StateReconnecting, reason)
+		conn = m.reconnect()
+		if conn == nil {
+			return
+		}
+		m.setState(StateConnected, nil)
+	}
+}
+
+func (m *ManagedConnection) reconnect() Connection {
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-m.done:
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+
+		conn, err := m.dial()
+		if err != nil {
+			m.setState(StateReconnecting, err)
+			continue
+		}
+		if err := m.resubscribe(conn); err != nil {
+			conn.Close()
+			m.setState(StateReconnecting, err)
+			continue
+		}
+		return conn
+	}
+}
+
+func (m *ManagedConnection) resubscribe(conn Connection) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	m.conn = conn
+	if m.pubCh != nil {
+		m.pubCh.Close()
+		m.pubCh = nil
+	}
+	m.mu.Unlock()
+	for _, s := range m.subs {
+		if err := s.start(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ManagedConnection) setState(state ConnState, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateClosed {
+		return
+	}
+	m.setStateLocked(state, err)
+}
+
+func (m *ManagedConnection) setStateLocked(state ConnState, err error) {
+	// A nil *amqp.Error from a graceful close must not become a non-nil error.
+	if reason, ok := err.(*amqp.Error); ok && reason == nil {
+		err = nil
+	}
+	if err != nil {
+		m.lastErr = err
+	}
+	changed := m.state != state
+	m.state = state
+	if !changed {
+		return
+	}
+	for _, listener := range m.listeners {
+		select {
+		case listener <- state:
+		default:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestManagedReconnect restarts the broker under a subscription and checks
+// the connection comes back and the subscription with it.
+func TestManagedReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := NewMemoryBroker()
+	conn, err := NewManagedConnection(broker.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := channel(t, conn).ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	states := conn.NotifyState(make(chan ConnState, 4))
+
+	received := make(chan string, 4)
+	sub, err := SubscribeJSON(ctx, conn, "peril_topic", "game_logs.alice", "game_logs.*", TransientQueue,
+		func(msg string) AckType {
+			received <- msg
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := PublishJSON(conn, "peril_topic", "game_logs.alice", "before"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveMsg(t, received); got != "before" {
+		t.Fatalf("got %q, want before", got)
+	}
+
+	broker.Restart()
+	for _, want := range []ConnState{StateReconnecting, StateConnected} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("connection went %v, want %v", got, want)
+			}
+		case <-time.After(2 * reconnectMinDelay):
+			t.Fatalf("connection never went %v", want)
+		}
+	}
+
+	// The exclusive queue went with the old connection; the subscription
+	// declares it again, so publishing may race it for a moment.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := PublishJSON(conn, "peril_topic", "game_logs.alice", "after"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received:
+			if got != "after" {
+				t.Fatalf("got %q, want after", got)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing published after the restart was delivered")
+		}
+	}
+}
+
+func receiveMsg(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+		return ""
+	}
+}
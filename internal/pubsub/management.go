@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ManagementClient reads the live topology of a RabbitMQ virtual host from
+// the management plugin's HTTP API, which AMQP itself has no way to list.
+type ManagementClient struct {
+	baseURL  string
+	username string
+	password string
+	vhost    string
+	client   *http.Client
+}
+
+func NewManagementClient(baseURL, username, password string) *ManagementClient {
+	return &ManagementClient{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		vhost:    "/",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type managementExchange struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+}
+
+type managementQueue struct {
+	Name       string         `json:"name"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Exclusive  bool           `json:"exclusive"`
+	Arguments  map[string]any `json:"arguments"`
+}
+
+type managementBinding struct {
+	Source          string `json:"source"`
+	Destination     string `json:"destination"`
+	DestinationType string `json:"destination_type"`
+	RoutingKey      string `json:"routing_key"`
+}
+
+func (c *ManagementClient) Topology() (Topology, error) {
+	var t Topology
+
+	var exchanges []managementExchange
+	if err := c.get("exchanges", &exchanges); err != nil {
+		return Topology{}, err
+	}
+	for _, ex := range exchanges {
+		t.Exchanges = append(t.Exchanges, ExchangeSpec{
+			Name:       ex.Name,
+			Kind:       ex.Type,
+			Durable:    ex.Durable,
+			AutoDelete: ex.AutoDelete,
+		})
+	}
+
+	var queues []managementQueue
+	if err := c.get("queues", &queues); err != nil {
+		return Topology{}, err
+	}
+	for _, q := range queues {
+		t.Queues = append(t.Queues, QueueSpec{
+			Name:       q.Name,
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Exclusive:  q.Exclusive,
+			Args:       q.Arguments,
+		})
+	}
+
+	var bindings []managementBinding
+	if err := c.get("bindings", &bindings); err != nil {
+		return Topology{}, err
+	}
+	for _, b := range bindings {
+		// Skip the implicit default-exchange binding every queue has.
+		if b.Source == "" || b.DestinationType != "queue" {
+			continue
+		}
+		t.Bindings = append(t.Bindings, BindingSpec{Exchange: b.Source, Queue: b.Destination, Key: b.RoutingKey})
+	}
+	return t, nil
+}
+
+func (c *ManagementClient) get(resource string, v any) error {
+	endpoint := fmt.Sprintf("%s/api/%s/%s", c.baseURL, resource, url.PathEscape(c.vhost))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("management API %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
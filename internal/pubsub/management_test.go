@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// managementAPI serves canned responses as the management plugin would for
+// the default virtual host.
+func managementAPI(t *testing.T) *httptest.Server {
+	responses := map[string]string{
+		"/api/exchanges/%2F": `[
+			{"name": "", "type": "direct", "durable": true, "auto_delete": false},
+			{"name": "peril_topic", "type": "topic", "durable": true, "auto_delete": false}
+		]`,
+		"/api/queues/%2F": `[
+			{"name": "game_logs", "durable": true, "auto_delete": false, "exclusive": false,
+			 "arguments": {"x-queue-type": "quorum", "x-max-length": 10000}},
+			{"name": "pause.alice", "durable": false, "auto_delete": true, "exclusive": true, "arguments": {}}
+		]`,
+		"/api/bindings/%2F": `[
+			{"source": "", "destination": "game_logs", "destination_type": "queue", "routing_key": "game_logs"},
+			{"source": "peril_topic", "destination": "game_logs", "destination_type": "queue", "routing_key": "game_logs.*"},
+			{"source": "peril_topic", "destination": "peril_audit", "destination_type": "exchange", "routing_key": "#"}
+		]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "guest" || password != "secret" {
+			http.Error(w, "not authorised", http.StatusUnauthorized)
+			return
+		}
+		body, ok := responses[r.URL.EscapedPath()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestManagementClientTopology(t *testing.T) {
+	server := managementAPI(t)
+	got, err := NewManagementClient(server.URL+"/", "guest", "secret").Topology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Numbers arrive as JSON numbers, whatever type they were declared with.
+	want := Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "", Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: "peril_topic", Kind: amqp.ExchangeTopic, Durable: true},
+		},
+		Queues: []QueueSpec{
+			{Name: "game_logs", Durable: true, Args: amqp.Table{"x-queue-type": "quorum", "x-max-length": float64(10000)}},
+			{Name: "pause.alice", AutoDelete: true, Exclusive: true, Args: amqp.Table{}},
+		},
+		// The default exchange's bindings and bindings to other exchanges
+		// are left out.
+		Bindings: []BindingSpec{{Exchange: "peril_topic", Queue: "game_logs", Key: "game_logs.*"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	// What it reads compares equal to the topology it describes.
+	logs := QueueOptions{Type: QueueQuorum, Durable: true, MaxLength: 10000}
+	expected := Topology{
+		Exchanges: want.Exchanges[1:],
+		Queues:    []QueueSpec{logs.Spec("game_logs")},
+		Bindings:  want.Bindings,
+	}
+	if diffs := Diff(expected, got); len(diffs) != 0 {
+		t.Errorf("the topology read differs from the one declared: %v", diffs)
+	}
+}
+
+func TestManagementClientErrors(t *testing.T) {
+	server := managementAPI(t)
+	_, err := NewManagementClient(server.URL, "guest", "wrong").Topology()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v, want the 401 reported", err)
+	}
+
+	server.Close()
+	if _, err := NewManagementClient(server.URL, "guest", "secret").Topology(); err == nil {
+		t.Error("read a topology from a server that has gone")
+	}
+}
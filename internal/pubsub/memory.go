@@ -0,0 +1,1132 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process broker that follows the RabbitMQ semantics
+// Peril relies on: direct, topic and fanout exchanges, durable, exclusive and
+// auto-delete queues, streams, prefetch, ack/nack/requeue, dead-lettering,
+// message TTLs, length limits and single active consumers.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     []*memConnection
+	nextID    int
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	owner      *memConnection
+	args       amqp.Table
+	messages   []*memMessage
+	consumers  []*memConsumer
+	next       int
+	// A stream keeps everything ever written to it in log, indexed by
+	// offset, instead of in messages.
+	stream bool
+	log    []*memMessage
+}
+
+type memMessage struct {
+	pub         amqp.Publishing
+	exchange    string
+	routingKey  string
+	redelivered bool
+	expiresAt   time.Time
+	// offset and storedAt place a message in a stream.
+	offset   int64
+	storedAt time.Time
+}
+
+type memConnection struct {
+	broker   *MemoryBroker
+	channels []*memChannel
+	closes   []chan *amqp.Error
+	closed   bool
+}
+
+type memChannel struct {
+	conn       *memConnection
+	prefetch   int
+	nextTag    uint64
+	unacked    map[uint64]*memUnacked
+	consumers  map[string]*memConsumer
+	confirming bool
+	publishSeq uint64
+	notifier   *memNotifier
+	closed     bool
+}
+
+// memNotifier delivers returns and publisher confirms from its own goroutine,
+// in publish order, the way amqp091 delivers them from its reader goroutine.
+type memNotifier struct {
+	mu       sync.Mutex
+	events   []interface{}
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+	wake     chan struct{}
+	done     chan struct{}
+	closed   bool
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	msg      *memMessage
+	consumer *memConsumer
+}
+
+type memConsumer struct {
+	tag      string
+	ch       *memChannel
+	queue    *memQueue
+	autoAck  bool
+	prefetch int
+	unacked  int
+	buf      []amqp.Delivery
+	out      chan amqp.Delivery
+	wake     chan struct{}
+	stop     chan struct{}
+	// cursor is the offset a stream consumer reads next.
+	cursor int64
+}
+
+// NewMemoryBroker returns an empty broker with the default exchanges
+// RabbitMQ pre-declares in every virtual host.
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+	}
+	for name, kind := range map[string]string{
+		"":           amqp.ExchangeDirect,
+		"amq.direct": amqp.ExchangeDirect,
+		"amq.topic":  amqp.ExchangeTopic,
+		"amq.fanout": amqp.ExchangeFanout,
+	} {
+		b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+// Dial opens a new connection to the broker.
+func (b *MemoryBroker) Dial() (Connection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &memConnection{broker: b}
+	b.conns = append(b.conns, c)
+	return c, nil
+}
+
+// Restart simulates a broker restart: every open connection is closed with a
+// CONNECTION_FORCED error and only durable exchanges and queues survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	reason := &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'", Server: true}
+	for _, c := range b.conns {
+		c.closeLocked(reason)
+	}
+	b.conns = nil
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueueLocked(q)
+		}
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+func (c *memConnection) Channel() (Channel, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      c,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+		notifier:  &memNotifier{wake: make(chan struct{}, 1), done: make(chan struct{})},
+	}
+	go ch.notifier.run()
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *memConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.closes = append(c.closes, receiver)
+	return receiver
+}
+
+func (c *memConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closeLocked(nil)
+	for i, other := range b.conns {
+		if other == c {
+			b.conns = append(b.conns[:i], b.conns[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// closeLocked tears the connection down. A nil reason is a graceful close,
+// which closes NotifyClose receivers without sending an error.
+func (c *memConnection) closeLocked(reason *amqp.Error) {
+	b := c.broker
+	c.closed = true
+	for _, ch := range c.channels {
+		ch.closeLocked()
+	}
+	c.channels = nil
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == c {
+			b.deleteQueueLocked(q)
+		}
+	}
+	for _, receiver := range c.closes {
+		if reason != nil {
+			// Like amqp091, listeners are notified without blocking the broker
+			// on a receiver nobody is reading.
+			select {
+			case receiver <- reason:
+			default:
+			}
+		}
+		close(receiver)
+	}
+	c.closes = nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return &amqp.Error{Code: amqp.CommandInvalid, Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind)}
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)}
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !sameArgs(q.args, args) {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)}
+		}
+		return amqp.Queue{Name: name, Messages: len(q.messages) + len(q.log), Consumers: len(q.consumers)}, nil
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		stream:     args["x-queue-type"] == "stream",
+	}
+	if (q.stream || args["x-queue-type"] == "quorum") && (!durable || autoDelete || exclusive) {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid property for queue '%s'", name)}
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	// Every queue is implicitly bound to the default exchange by its name.
+	b.exchanges[""].bindings = append(b.exchanges[""].bindings, memBinding{queue: q, key: name})
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return errNoQueue(name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return errNoExchange(exchange)
+	}
+	if exchange == "" {
+		return &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - operation not permitted on the default exchange"}
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == q && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: q, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, errNoQueue(queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, &amqp.Error{Code: amqp.ResourceLocked, Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)}
+	}
+	if consumer == "" {
+		b.nextID++
+		consumer = fmt.Sprintf("ctag-%d", b.nextID)
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)}
+	}
+	c := &memConsumer{
+		tag:      consumer,
+		ch:       ch,
+		queue:    q,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		out:      make(chan amqp.Delivery),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	if q.stream {
+		if autoAck || ch.prefetch == 0 {
+			return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - consumers of streams need manual acknowledgement and a prefetch count"}
+		}
+		cursor, err := q.streamCursor(args[HeaderStreamOffset])
+		if err != nil {
+			return nil, err
+		}
+		c.cursor = cursor
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	go c.run(b)
+	b.dispatchLocked(q)
+	return c.out, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		b.cancelConsumerLocked(c)
+	}
+	return nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, errNoQueue(queue)
+	}
+	b.expireLocked(q)
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	ch.nextTag++
+	if !autoAck {
+		ch.unacked[ch.nextTag] = &memUnacked{queue: q, msg: m}
+	}
+	d := toDelivery(ch, "", ch.nextTag, m)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, errNoQueue(name)
+	}
+	purged := len(q.messages)
+	q.messages = nil
+	return purged, nil
+}
+
+func (ch *memChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in use", name)}
+	}
+	if ifEmpty && len(q.messages) > 0 {
+		return 0, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' not empty", name)}
+	}
+	for _, c := range slices.Clone(q.consumers) {
+		b.cancelConsumerLocked(c)
+	}
+	deleted := len(q.messages)
+	b.deleteQueueLocked(q)
+	return deleted, nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[exchange]; !ok {
+		return errNoExchange(exchange)
+	}
+	routed, rejected := b.publishLocked(exchange, key, msg)
+	if mandatory && routed == 0 {
+		ch.notifier.push(amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		})
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		ch.notifier.push(amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: !rejected})
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	n := ch.notifier
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(confirm)
+		return confirm
+	}
+	n.confirms = append(n.confirms, confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	n := ch.notifier
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(c)
+		return c
+	}
+	n.returns = append(n.returns, c)
+	return c
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.closeLocked()
+	return nil
+}
+
+// Ack, Nack and Reject implement amqp.Acknowledger for deliveries handed out
+// by this channel.
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, q *memQueue, msgs []*memMessage) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, q *memQueue, msgs []*memMessage) {
+		if requeue {
+			b.requeueLocked(q, msgs)
+			return
+		}
+		for _, m := range msgs {
+			b.deadLetterLocked(q, m, "rejected")
+		}
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle removes the given deliveries from the channel's unacked set and
+// passes them, grouped by queue and in delivery order, to fn.
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*MemoryBroker, *memQueue, []*memMessage)) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; !ok {
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+	}
+	for q, msgs := range ch.takeUnacked(tags) {
+		fn(b, q, msgs)
+		b.dispatchLocked(q)
+	}
+	return nil
+}
+
+func (ch *memChannel) takeUnacked(tags []uint64) map[*memQueue][]*memMessage {
+	slices.Sort(tags)
+	byQueue := map[*memQueue][]*memMessage{}
+	for _, t := range tags {
+		u, ok := ch.unacked[t]
+		if !ok {
+			continue
+		}
+		delete(ch.unacked, t)
+		if u.consumer != nil {
+			u.consumer.unacked--
+		}
+		byQueue[u.queue] = append(byQueue[u.queue], u.msg)
+	}
+	return byQueue
+}
+
+func (ch *memChannel) closeLocked() {
+	b := ch.conn.broker
+	ch.closed = true
+	ch.notifier.close()
+	for _, c := range ch.consumers {
+		b.cancelConsumerLocked(c)
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	for q, msgs := range ch.takeUnacked(tags) {
+		b.requeueLocked(q, msgs)
+		b.dispatchLocked(q)
+	}
+}
+
+func (n *memNotifier) push(event interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+	n.signal()
+}
+
+func (n *memNotifier) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = true
+	close(n.done)
+	n.signal()
+}
+
+func (n *memNotifier) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *memNotifier) run() {
+	for {
+		n.mu.Lock()
+		if len(n.events) == 0 {
+			if n.closed {
+				for _, c := range n.confirms {
+					close(c)
+				}
+				for _, c := range n.returns {
+					close(c)
+				}
+				n.mu.Unlock()
+				return
+			}
+			n.mu.Unlock()
+			<-n.wake
+			continue
+		}
+		event := n.events[0]
+		n.events = n.events[1:]
+		confirms := slices.Clone(n.confirms)
+		returns := slices.Clone(n.returns)
+		n.mu.Unlock()
+		switch event := event.(type) {
+		case amqp.Confirmation:
+			for _, c := range confirms {
+				notify(c, event, n.done)
+			}
+		case amqp.Return:
+			for _, c := range returns {
+				notify(c, event, n.done)
+			}
+		}
+	}
+}
+
+// notify sends event to c, giving up once the channel is closed if nobody
+// is receiving.
+func notify[T any](c chan T, event T, done chan struct{}) {
+	select {
+	case c <- event:
+		return
+	default:
+	}
+	select {
+	case c <- event:
+	case <-done:
+	}
+}
+
+// publishLocked routes msg to every matching queue, reporting how many it
+// reached and whether any refused it for being full.
+func (b *MemoryBroker) publishLocked(exchange, key string, msg amqp.Publishing) (routed int, rejected bool) {
+	ex := b.exchanges[exchange]
+	seen := map[*memQueue]struct{}{}
+	for _, binding := range ex.bindings {
+		if _, ok := seen[binding.queue]; ok {
+			continue
+		}
+		if !bindingMatches(ex.kind, binding.key, key) {
+			continue
+		}
+		seen[binding.queue] = struct{}{}
+		accepted := b.enqueueLocked(binding.queue, &memMessage{
+			pub:        copyPublishing(msg),
+			exchange:   exchange,
+			routingKey: key,
+		})
+		if !accepted {
+			rejected = true
+		}
+		routed++
+	}
+	return routed, rejected
+}
+
+// enqueueLocked adds m to q, unless q is full and refuses new messages.
+func (b *MemoryBroker) enqueueLocked(q *memQueue, m *memMessage) bool {
+	if q.stream {
+		m.offset = int64(len(q.log))
+		m.storedAt = time.Now()
+		q.log = append(q.log, m)
+		b.dispatchLocked(q)
+		return true
+	}
+	if _, ok := q.args["x-max-length"]; ok {
+		b.expireLocked(q)
+		limit := int(headerInt(q.args, "x-max-length"))
+		if len(q.messages) >= limit {
+			switch q.args["x-overflow"] {
+			case "reject-publish":
+				return false
+			case "reject-publish-dlx":
+				b.deadLetterLocked(q, m, "maxlen")
+				return false
+			default:
+				for len(q.messages) > 0 && len(q.messages) >= limit {
+					head := q.messages[0]
+					q.messages = q.messages[1:]
+					b.deadLetterLocked(q, head, "maxlen")
+				}
+			}
+		}
+	}
+	if ttl, ok := messageTTL(q, m); ok {
+		m.expiresAt = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expireLocked(q)
+			b.dispatchLocked(q)
+		})
+	}
+	q.messages = append(q.messages, m)
+	b.dispatchLocked(q)
+	return true
+}
+
+// messageTTL is the smaller of the queue's x-message-ttl and the message's
+// own expiration, if either is set.
+func messageTTL(q *memQueue, m *memMessage) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+	if _, set := q.args["x-message-ttl"]; set {
+		ttl, ok = time.Duration(headerInt(q.args, "x-message-ttl"))*time.Millisecond, true
+	}
+	if m.pub.Expiration != "" {
+		if ms, err := strconv.ParseInt(m.pub.Expiration, 10, 64); err == nil {
+			if !ok || time.Duration(ms)*time.Millisecond < ttl {
+				ttl, ok = time.Duration(ms)*time.Millisecond, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// expireLocked dead-letters expired messages. Like RabbitMQ it only looks at
+// the head of the queue.
+func (b *MemoryBroker) expireLocked(q *memQueue) {
+	if b.queues[q.name] != q {
+		return
+	}
+	now := time.Now()
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if m.expiresAt.IsZero() || m.expiresAt.After(now) {
+			return
+		}
+		q.messages = q.messages[1:]
+		b.deadLetterLocked(q, m, "expired")
+	}
+}
+
+// requeueLocked puts msgs back at the head of q, keeping their order.
+// Streams keep every message anyway, so there is nothing to put back.
+func (b *MemoryBroker) requeueLocked(q *memQueue, msgs []*memMessage) {
+	if b.queues[q.name] != q || q.stream {
+		return
+	}
+	for _, m := range msgs {
+		m.redelivered = true
+	}
+	q.messages = append(append([]*memMessage{}, msgs...), q.messages...)
+}
+
+// deadLetterLocked republishes m to the queue's dead-letter exchange, if it
+// has one, recording the reason in the x-death header as RabbitMQ does.
+func (b *MemoryBroker) deadLetterLocked(q *memQueue, m *memMessage, reason string) {
+	if q.stream {
+		return
+	}
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	if _, ok := b.exchanges[dlx]; !ok {
+		return
+	}
+	key := m.routingKey
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	pub := copyPublishing(m.pub)
+	if pub.Headers == nil {
+		pub.Headers = amqp.Table{}
+	}
+	pub.Headers["x-death"] = addDeath(pub.Headers["x-death"], q.name, reason, m.exchange, m.routingKey)
+	b.publishLocked(dlx, key, pub)
+}
+
+func addDeath(existing interface{}, queue, reason, exchange, key string) []interface{} {
+	deaths, _ := existing.([]interface{})
+	for i, d := range deaths {
+		entry, ok := d.(amqp.Table)
+		if !ok || entry["queue"] != queue || entry["reason"] != reason {
+			continue
+		}
+		count, _ := entry["count"].(int64)
+		entry["count"] = count + 1
+		entry["time"] = time.Now().UTC()
+		rest := append(append([]interface{}{}, deaths[:i]...), deaths[i+1:]...)
+		return append([]interface{}{entry}, rest...)
+	}
+	entry := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now().UTC(),
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	return append([]interface{}{entry}, deaths...)
+}
+
+func (b *MemoryBroker) dispatchLocked(q *memQueue) {
+	if q.stream {
+		b.dispatchStreamLocked(q)
+		return
+	}
+	b.expireLocked(q)
+	for len(q.messages) > 0 {
+		c := q.readyConsumer()
+		if c == nil {
+			return
+		}
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		c.ch.nextTag++
+		tag := c.ch.nextTag
+		if !c.autoAck {
+			c.ch.unacked[tag] = &memUnacked{queue: q, msg: m, consumer: c}
+			c.unacked++
+		}
+		c.buf = append(c.buf, toDelivery(c.ch, c.tag, tag, m))
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatchStreamLocked sends every stream consumer what it hasn't read yet,
+// as far as its prefetch allows.
+func (b *MemoryBroker) dispatchStreamLocked(q *memQueue) {
+	for _, c := range q.consumers {
+		sent := false
+		for c.cursor < int64(len(q.log)) && c.unacked < c.prefetch {
+			m := q.log[c.cursor]
+			c.cursor++
+			c.ch.nextTag++
+			tag := c.ch.nextTag
+			c.ch.unacked[tag] = &memUnacked{queue: q, msg: m, consumer: c}
+			c.unacked++
+			d := toDelivery(c.ch, c.tag, tag, m)
+			if d.Headers == nil {
+				d.Headers = amqp.Table{}
+			}
+			d.Headers[HeaderStreamOffset] = m.offset
+			c.buf = append(c.buf, d)
+			sent = true
+		}
+		if sent {
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// streamCursor turns an x-stream-offset argument into the offset to read
+// from. A stream written in one go is a single chunk here, so "last" starts
+// from its last message.
+func (q *memQueue) streamCursor(arg interface{}) (int64, error) {
+	switch arg := arg.(type) {
+	case nil:
+		return int64(len(q.log)), nil
+	case string:
+		switch arg {
+		case "first":
+			return 0, nil
+		case "last":
+			return max(int64(len(q.log))-1, 0), nil
+		case "next":
+			return int64(len(q.log)), nil
+		}
+	case int, int8, int16, int32, int64:
+		n := headerInt(amqp.Table{"n": arg}, "n")
+		return min(max(n, 0), int64(len(q.log))), nil
+	case time.Time:
+		since := arg.Truncate(time.Second)
+		i, _ := slices.BinarySearchFunc(q.log, since, func(m *memMessage, t time.Time) int {
+			return m.storedAt.Compare(t)
+		})
+		return int64(i), nil
+	}
+	return 0, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid x-stream-offset %v", arg)}
+}
+
+func (q *memQueue) readyConsumer() *memConsumer {
+	if q.args["x-single-active-consumer"] == true && len(q.consumers) > 0 {
+		// The longest-standing consumer is the active one.
+		c := q.consumers[0]
+		if c.autoAck || c.prefetch == 0 || c.unacked < c.prefetch {
+			return c
+		}
+		return nil
+	}
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.autoAck || c.prefetch == 0 || c.unacked < c.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) cancelConsumerLocked(c *memConsumer) {
+	q := c.queue
+	delete(c.ch.consumers, c.tag)
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	close(c.stop)
+	// Deliveries the application never received go back to the queue.
+	tags := make([]uint64, 0, len(c.buf))
+	for _, d := range c.buf {
+		tags = append(tags, d.DeliveryTag)
+	}
+	c.buf = nil
+	for q, msgs := range c.ch.takeUnacked(tags) {
+		b.requeueLocked(q, msgs)
+	}
+	if q.autoDelete && len(q.consumers) == 0 {
+		b.deleteQueueLocked(q)
+		return
+	}
+	b.dispatchLocked(q)
+}
+
+func (b *MemoryBroker) deleteQueueLocked(q *memQueue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q {
+				kept = append(kept, binding)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+// run hands buffered deliveries to the application one at a time so that a
+// slow consumer never blocks the broker.
+func (c *memConsumer) run(b *MemoryBroker) {
+	defer close(c.out)
+	for {
+		b.mu.Lock()
+		if len(c.buf) == 0 {
+			b.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.stop:
+				return
+			}
+		}
+		d := c.buf[0]
+		c.buf = c.buf[1:]
+		b.mu.Unlock()
+		select {
+		case c.out <- d:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func toDelivery(ch *memChannel, consumerTag string, tag uint64, m *memMessage) amqp.Delivery {
+	pub := copyPublishing(m.pub)
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         pub.Headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            pub.Body,
+	}
+}
+
+func copyPublishing(p amqp.Publishing) amqp.Publishing {
+	if p.Headers != nil {
+		headers := amqp.Table{}
+		for k, v := range p.Headers {
+			headers[k] = v
+		}
+		p.Headers = headers
+	}
+	p.Body = append([]byte(nil), p.Body...)
+	return p
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+// topicMatches implements AMQP topic matching: `*` matches exactly one word
+// and `#` matches zero or more words.
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+func sameArgs(a, b amqp.Table) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func errNoQueue(name string) error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s' in vhost '/'", name)}
+}
+
+func errNoExchange(name string) error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", name)}
+}
@@ -0,0 +1,272 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"state.alice", "state.alice", true},
+		{"state.alice", "state.bob", false},
+		{"state.*", "state.alice", true},
+		{"state.*", "state", false},
+		{"state.*", "state.alice.extra", false},
+		{"*.alice", "war.alice", true},
+		{"#", "", true},
+		{"#", "game_logs.alice", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice.today", true},
+		{"#.alice", "war.alice", true},
+		{"#.alice", "war.bob", false},
+		{"war.#.alice", "war.alice", true},
+		{"war.#.alice", "war.europe.asia.alice", true},
+		{"*.*", "state", false},
+	}
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare("topic", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			q, err := ch.QueueDeclare("", false, true, true, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.QueueBind(q.Name, tt.pattern, "topic", false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.PublishWithContext(context.Background(), "topic", tt.key, false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			_, got, err := ch.Get(q.Name, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%q routed to %q = %v, want %v", tt.key, tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAckNackRequeue(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	ch := channel(t, conn)
+	q, err := ch.QueueDeclare("moves", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := ch.PublishWithContext(context.Background(), "", q.Name, false, false, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := receive(t, deliveries)
+	if string(d.Body) != "first" || d.Redelivered {
+		t.Fatalf("got %q (redelivered %v), want a first delivery of first", d.Body, d.Redelivered)
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	// A requeued message goes back to the head of the queue.
+	d = receive(t, deliveries)
+	if string(d.Body) != "first" || !d.Redelivered {
+		t.Fatalf("got %q (redelivered %v), want first redelivered", d.Body, d.Redelivered)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, deliveries)
+	if string(d.Body) != "second" {
+		t.Fatalf("got %q, want second", d.Body)
+	}
+	// Without a dead-letter exchange a discarded message is gone.
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(false); err == nil {
+		t.Error("acking a settled delivery succeeded")
+	}
+	select {
+	case d := <-deliveries:
+		t.Fatalf("got %q after every message was settled", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnackedRequeuedOnClose(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	ch := channel(t, conn)
+	q, err := ch.QueueDeclare("moves", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", q.Name, false, false, amqp.Publishing{Body: []byte("move")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := ch.Get(q.Name, false); err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch = channel(t, conn)
+	d, ok, err := ch.Get(q.Name, true)
+	if err != nil || !ok {
+		t.Fatalf("Get after close = %v, %v, want the unacked message back", ok, err)
+	}
+	if !d.Redelivered {
+		t.Error("message returned by a closed channel is not marked redelivered")
+	}
+}
+
+func TestDeadLetterThroughDLX(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare(DeadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("peril_topic", amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("peril_dlq", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("peril_dlq", "", DeadLetterExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []string
+	sub, err := Subscribe(context.Background(), conn, JSON, "peril_topic", "game_logs", "game_logs.*", DurableQueue,
+		func(msg string) AckType {
+			handled = append(handled, msg)
+			if msg == "spam" {
+				return NackDiscard
+			}
+			return Ack
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "spam"} {
+		if err := PublishJSON(ch, "peril_topic", "game_logs.alice", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := getEventually(t, ch, "peril_dlq")
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 2 {
+		t.Errorf("handled %v, want both messages", handled)
+	}
+
+	dl := ParseDeadLetter(d)
+	if dl.Queue != "game_logs" || dl.Exchange != "peril_topic" || dl.RoutingKey != "game_logs.alice" || dl.Reason != "rejected" || dl.Count != 1 {
+		t.Errorf("dead letter from %s via %s/%s (%s, %d time(s)), want game_logs via peril_topic/game_logs.alice (rejected, 1 time)",
+			dl.Queue, dl.Exchange, dl.RoutingKey, dl.Reason, dl.Count)
+	}
+	body, err := Decode[string](d)
+	if err != nil || body != "spam" {
+		t.Errorf("dead letter is %q (%v), want spam", body, err)
+	}
+	if _, ok, _ := ch.Get("peril_dlq", true); ok {
+		t.Error("the acked message was dead-lettered too")
+	}
+}
+
+func TestDeadLetterOnExpiry(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare(DeadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("peril_dlq", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("peril_dlq", "", DeadLetterExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	opts := QueueOptions{Durable: true, MessageTTL: 10 * time.Millisecond, DeadLetterExchange: DeadLetterExchange}
+	if _, err := ch.QueueDeclare("requests", opts.Durable, false, false, false, opts.Arguments()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.PublishWithContext(context.Background(), "", "requests", false, false, amqp.Publishing{Body: []byte("late")}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := getEventually(t, ch, "peril_dlq")
+	if dl := ParseDeadLetter(d); dl.Queue != "requests" || dl.Reason != "expired" {
+		t.Errorf("dead letter from %s (%s), want requests (expired)", dl.Queue, dl.Reason)
+	}
+}
+
+func dial(t *testing.T, broker *MemoryBroker) Connection {
+	t.Helper()
+	conn, err := broker.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func channel(t *testing.T, conn Connection) Channel {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+		return amqp.Delivery{}
+	}
+}
+
+// getEventually waits for a message to arrive in queue.
+func getEventually(t *testing.T, ch Channel, queue string) amqp.Delivery {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		d, ok, err := ch.Get(queue, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			return d
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("nothing arrived in %s", queue)
+	return amqp.Delivery{}
+}
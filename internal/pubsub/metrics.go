@@ -0,0 +1,222 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names, as exposed in the Prometheus text format.
+const (
+	MetricPublished      = "peril_messages_published_total"
+	MetricPublishErrors  = "peril_publish_errors_total"
+	MetricConsumed       = "peril_messages_consumed_total"
+	MetricAcked          = "peril_messages_acked_total"
+	MetricNackedRequeue  = "peril_messages_nacked_requeue_total"
+	MetricNackedDiscard  = "peril_messages_nacked_discard_total"
+	MetricDecodeFailures = "peril_decode_failures_total"
+	MetricDuplicates     = "peril_messages_duplicate_total"
+	MetricPayloadBytes   = "peril_publish_payload_bytes_total"
+	MetricWireBytes      = "peril_publish_wire_bytes_total"
+	MetricHandlerLatency = "peril_handler_duration_seconds"
+)
+
+type metricDesc struct {
+	name  string
+	help  string
+	label string
+}
+
+var counterDescs = []metricDesc{
+	{MetricPublished, "Messages published, by exchange.", "exchange"},
+	{MetricPublishErrors, "Messages that failed to publish, by exchange.", "exchange"},
+	{MetricPayloadBytes, "Bytes of message bodies published before compression, by exchange.", "exchange"},
+	{MetricWireBytes, "Bytes of message bodies published as sent, after any compression, by exchange.", "exchange"},
+	{MetricConsumed, "Messages delivered to subscribers, by queue.", "queue"},
+	{MetricAcked, "Messages acknowledged, by queue.", "queue"},
+	{MetricNackedRequeue, "Messages negatively acknowledged and requeued or retried, by queue.", "queue"},
+	{MetricNackedDiscard, "Messages negatively acknowledged and discarded, by queue.", "queue"},
+	{MetricDecodeFailures, "Messages that could not be decoded, by queue.", "queue"},
+	{MetricDuplicates, "Redeliveries of messages already handled that were skipped, by queue.", "queue"},
+}
+
+var latencyDesc = metricDesc{MetricHandlerLatency, "Time spent in message handlers, by queue.", "queue"}
+
+// LatencyBuckets are the upper bounds of the handler latency histogram.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// DefaultMetrics collects the metrics of publishes and subscriptions that
+// are not given their own registry with WithPublishMetrics or WithMetrics.
+var DefaultMetrics = NewMetrics()
+
+// WithPublishMetrics records the publish's metrics in m instead of
+// DefaultMetrics.
+func WithPublishMetrics(m *Metrics) PublishOption {
+	return func(o *publishOptions) {
+		if m != nil {
+			o.metrics = m
+		}
+	}
+}
+
+// Metrics counts messages per exchange and queue. It is safe for concurrent
+// use and serves the Prometheus text format over HTTP.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]uint64
+	latency  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: map[string]map[string]uint64{},
+		latency:  map[string]*histogram{},
+	}
+}
+
+func (m *Metrics) inc(metric, label string) {
+	m.add(metric, label, 1)
+}
+
+func (m *Metrics) add(metric, label string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, ok := m.counters[metric]
+	if !ok {
+		values = map[string]uint64{}
+		m.counters[metric] = values
+	}
+	values[label] += uint64(n)
+}
+
+func (m *Metrics) observe(queue string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latency[queue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(LatencyBuckets))}
+		m.latency[queue] = h
+	}
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+// MetricsSnapshot is a copy of a registry's values at one point in time.
+// Counters are keyed by metric name and then by exchange or queue.
+type MetricsSnapshot struct {
+	Counters       map[string]map[string]uint64
+	HandlerLatency map[string]HistogramSnapshot
+}
+
+// Counter returns the value of a counter for one exchange or queue.
+func (s MetricsSnapshot) Counter(metric, label string) uint64 {
+	return s.Counters[metric][label]
+}
+
+// HistogramSnapshot holds cumulative counts for each of LatencyBuckets.
+type HistogramSnapshot struct {
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Counters:       map[string]map[string]uint64{},
+		HandlerLatency: map[string]HistogramSnapshot{},
+	}
+	for metric, values := range m.counters {
+		copied := map[string]uint64{}
+		for label, v := range values {
+			copied[label] = v
+		}
+		s.Counters[metric] = copied
+	}
+	for queue, h := range m.latency {
+		s.HandlerLatency[queue] = HistogramSnapshot{
+			Buckets: slices.Clone(h.counts),
+			Count:   h.count,
+			Sum:     h.sum,
+		}
+	}
+	return s
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	s := m.Snapshot()
+	bw := bufio.NewWriter(w)
+	for _, desc := range counterDescs {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", desc.name, desc.help, desc.name)
+		values := s.Counters[desc.name]
+		for _, label := range sortedLabels(values) {
+			fmt.Fprintf(bw, "%s{%s=%s} %d\n", desc.name, desc.label, quoteLabel(label), values[label])
+		}
+	}
+
+	desc := latencyDesc
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", desc.name, desc.help, desc.name)
+	for _, queue := range sortedLabels(s.HandlerLatency) {
+		h := s.HandlerLatency[queue]
+		label := desc.label + "=" + quoteLabel(queue)
+		for i, bound := range LatencyBuckets {
+			le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+			fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", desc.name, label, le, h.Buckets[i])
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", desc.name, label, h.Count)
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", desc.name, label, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", desc.name, label, h.Count)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics for a Prometheus scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+func sortedLabels[V any](values map[string]V) []string {
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	return labels
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithPublishMetrics(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	if err := channel(t, conn).ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	before := DefaultMetrics.Snapshot().Counter(MetricPublished, "peril_topic")
+
+	// The confirmed publisher fails the publish, since nothing is bound.
+	confirmed := NewConfirmedPublisher(conn, time.Second)
+	defer confirmed.Close()
+	if err := PublishJSON(confirmed, "peril_topic", "game_logs.alice", "lost", WithPublishMetrics(m)); err == nil {
+		t.Fatal("publishing to nobody succeeded")
+	}
+	if err := PublishJSON(channel(t, conn), "peril_topic", "game_logs.alice", "hello", WithPublishMetrics(m)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Snapshot().Counter(MetricPublished, "peril_topic"); got != 1 {
+		t.Errorf("published %d, want 1", got)
+	}
+	if got := m.Snapshot().Counter(MetricPublishErrors, "peril_topic"); got != 1 {
+		t.Errorf("publish errors %d, want 1", got)
+	}
+	if got := DefaultMetrics.Snapshot().Counter(MetricPublished, "peril_topic"); got != before {
+		t.Errorf("DefaultMetrics counted %d publishes, want none", got-before)
+	}
+}
+
+// golden is what WritePrometheus writes for the registry goldenMetrics
+// fills in.
+const golden = `# HELP peril_messages_published_total Messages published, by exchange.
+# TYPE peril_messages_published_total counter
+peril_messages_published_total{exchange="peril_direct"} 1
+peril_messages_published_total{exchange="peril_topic"} 3
+# HELP peril_publish_errors_total Messages that failed to publish, by exchange.
+# TYPE peril_publish_errors_total counter
+# HELP peril_publish_payload_bytes_total Bytes of message bodies published before compression, by exchange.
+# TYPE peril_publish_payload_bytes_total counter
+# HELP peril_publish_wire_bytes_total Bytes of message bodies published as sent, after any compression, by exchange.
+# TYPE peril_publish_wire_bytes_total counter
+# HELP peril_messages_consumed_total Messages delivered to subscribers, by queue.
+# TYPE peril_messages_consumed_total counter
+# HELP peril_messages_acked_total Messages acknowledged, by queue.
+# TYPE peril_messages_acked_total counter
+peril_messages_acked_total{queue="game_logs"} 1
+# HELP peril_messages_nacked_requeue_total Messages negatively acknowledged and requeued or retried, by queue.
+# TYPE peril_messages_nacked_requeue_total counter
+# HELP peril_messages_nacked_discard_total Messages negatively acknowledged and discarded, by queue.
+# TYPE peril_messages_nacked_discard_total counter
+peril_messages_nacked_discard_total{queue="odd \"queue\"\\\n"} 1
+# HELP peril_decode_failures_total Messages that could not be decoded, by queue.
+# TYPE peril_decode_failures_total counter
+# HELP peril_messages_duplicate_total Redeliveries of messages already handled that were skipped, by queue.
+# TYPE peril_messages_duplicate_total counter
+# HELP peril_handler_duration_seconds Time spent in message handlers, by queue.
+# TYPE peril_handler_duration_seconds histogram
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.001"} 0
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.005"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.01"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.05"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.1"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="0.5"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="1"} 1
+peril_handler_duration_seconds_bucket{queue="game_logs",le="5"} 2
+peril_handler_duration_seconds_bucket{queue="game_logs",le="10"} 2
+peril_handler_duration_seconds_bucket{queue="game_logs",le="+Inf"} 2
+peril_handler_duration_seconds_sum{queue="game_logs"} 2.003
+peril_handler_duration_seconds_count{queue="game_logs"} 2
+`
+
+func goldenMetrics() *Metrics {
+	m := NewMetrics()
+	m.add(MetricPublished, "peril_topic", 3)
+	m.inc(MetricPublished, "peril_direct")
+	m.inc(MetricAcked, "game_logs")
+	m.inc(MetricNackedDiscard, "odd \"queue\"\\\n")
+	m.observe("game_logs", 3*time.Millisecond)
+	m.observe("game_logs", 2*time.Second)
+	return m
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	if err := goldenMetrics().WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != golden {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), golden)
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	w := httptest.NewRecorder()
+	goldenMetrics().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("served as %q, want the Prometheus text format", ct)
+	}
+	if w.Body.String() != golden {
+		t.Errorf("got\n%s\nwant\n%s", w.Body.String(), golden)
+	}
+}
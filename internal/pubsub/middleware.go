@@ -0,0 +1,191 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Delivery is a decoded message as middleware sees it. Body holds the
+// subscription's message type.
+type Delivery struct {
+	Envelope
+	Queue string
+	Body  any
+	Raw   amqp.Delivery
+}
+
+// HandlerFunc handles a delivery and says how to settle it.
+type HandlerFunc func(ctx context.Context, d *Delivery) AckType
+
+// Middleware wraps a handler with behaviour shared across subscriptions.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// WithMiddleware wraps the subscription's handler in mw, the first one
+// outermost. Every subscription recovers from handler panics regardless.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+func chain(h HandlerFunc, mw []Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into a discarded message, so one bad
+// message doesn't stop the subscription.
+func Recover(logger *slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) (ack AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("handler panicked, discarding message",
+						"queue", d.Queue, "message_id", d.ID, "panic", r, "stack", string(debug.Stack()))
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, d)
+		}
+	}
+}
+
+// Timing reports how long each delivery took to handle and how it was
+// settled.
+func Timing(report func(d *Delivery, elapsed time.Duration, ack AckType)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) AckType {
+			start := time.Now()
+			ack := next(ctx, d)
+			report(d, time.Since(start), ack)
+			return ack
+		}
+	}
+}
+
+// Logging logs every delivery at level once it has been handled.
+func Logging(logger *slog.Logger, level slog.Level) Middleware {
+	return Timing(func(d *Delivery, elapsed time.Duration, ack AckType) {
+		logger.Log(context.Background(), level, "handled message",
+			"queue", d.Queue,
+			"routing_key", d.RoutingKey,
+			"message_id", d.ID,
+			"type", d.Type,
+			"sender", d.Sender,
+			"ack", ack.String(),
+			"elapsed", elapsed,
+		)
+	})
+}
+
+// Timeout gives the handler a context that is cancelled after d. A handler
+// still running then is abandoned and the message requeued; handlers should
+// watch ctx so they stop rather than finish the work a second time. The
+// handler runs in a goroutine of its own, beyond the reach of the
+// subscription's Recover, so Timeout recovers its panics itself.
+func Timeout(logger *slog.Logger, d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		handle := Recover(logger)(next)
+		return func(ctx context.Context, delivery *Delivery) AckType {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			result := make(chan AckType, 1)
+			go func() {
+				result <- handle(ctx, delivery)
+			}()
+			select {
+			case ack := <-result:
+				return ack
+			case <-ctx.Done():
+				return NackRequeue
+			}
+		}
+	}
+}
+
+// RateLimit lets at most n deliveries through per interval, making the rest
+// wait their turn. Shared between subscriptions, it limits them together.
+func RateLimit(n int, per time.Duration) Middleware {
+	limiter := &tokenBucket{
+		capacity: float64(n),
+		tokens:   float64(n),
+		rate:     float64(n) / per.Seconds(),
+		last:     time.Now(),
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) AckType {
+			if err := limiter.wait(ctx); err != nil {
+				return NackRequeue
+			}
+			return next(ctx, d)
+		}
+	}
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Authorize discards deliveries that check rejects, such as messages whose
+// sender may not send them.
+func Authorize(logger *slog.Logger, check func(d *Delivery) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) AckType {
+			if err := check(d); err != nil {
+				logger.Warn("discarding unauthorized message",
+					"queue", d.Queue, "message_id", d.ID, "sender", d.Sender, "error", err)
+				return NackDiscard
+			}
+			return next(ctx, d)
+		}
+	}
+}
+
+// RequireSender is an Authorize check that only accepts messages from one of
+// senders.
+func RequireSender(senders ...string) func(d *Delivery) error {
+	return func(d *Delivery) error {
+		for _, sender := range senders {
+			if d.Sender == sender {
+				return nil
+			}
+		}
+		return fmt.Errorf("sender %q is not allowed", d.Sender)
+	}
+}
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+	h := Recover(slog.New(slog.NewTextHandler(&logs, nil)))(func(context.Context, *Delivery) AckType {
+		panic("bad message")
+	})
+	if ack := h(context.Background(), &Delivery{Queue: "moves"}); ack != NackDiscard {
+		t.Errorf("panicking handler settled with %v, want %v", ack, NackDiscard)
+	}
+	if !strings.Contains(logs.String(), "bad message") {
+		t.Errorf("the panic wasn't logged: %s", logs.String())
+	}
+
+	h = Recover(discardLogger)(func(context.Context, *Delivery) AckType { return NackRequeue })
+	if ack := h(context.Background(), &Delivery{}); ack != NackRequeue {
+		t.Errorf("got %v, want the handler's own %v", ack, NackRequeue)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler HandlerFunc
+		want    AckType
+	}{
+		{"finishes in time", func(context.Context, *Delivery) AckType { return Ack }, Ack},
+		{"runs over", func(ctx context.Context, _ *Delivery) AckType {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			return Ack
+		}, NackRequeue},
+		{"panics", func(context.Context, *Delivery) AckType { panic("bad message") }, NackDiscard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Timeout(discardLogger, 20*time.Millisecond)(tt.handler)
+			if ack := h(context.Background(), &Delivery{}); ack != tt.want {
+				t.Errorf("got %v, want %v", ack, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(2, 100*time.Millisecond)(func(context.Context, *Delivery) AckType { return Ack })
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if ack := h(context.Background(), &Delivery{}); ack != Ack {
+			t.Fatalf("delivery %d settled with %v", i, ack)
+		}
+	}
+	// Two go straight through; the third waits half the interval for a
+	// token.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("three deliveries took %v, want the third held up", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ack := h(ctx, &Delivery{}); ack != NackRequeue {
+		t.Errorf("waiting with a cancelled context settled with %v, want %v", ack, NackRequeue)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var (
+		reported time.Duration
+		settled  AckType
+	)
+	h := Timing(func(_ *Delivery, elapsed time.Duration, ack AckType) {
+		reported, settled = elapsed, ack
+	})(func(context.Context, *Delivery) AckType {
+		time.Sleep(10 * time.Millisecond)
+		return NackRequeue
+	})
+	if ack := h(context.Background(), &Delivery{}); ack != NackRequeue {
+		t.Errorf("got %v, want %v", ack, NackRequeue)
+	}
+	if reported < 10*time.Millisecond || settled != NackRequeue {
+		t.Errorf("reported %v and %v, want at least 10ms and %v", reported, settled, NackRequeue)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	h := Logging(slog.New(slog.NewTextHandler(&logs, nil)), slog.LevelInfo)(func(context.Context, *Delivery) AckType {
+		return Ack
+	})
+	d := &Delivery{Queue: "game_logs", Envelope: Envelope{ID: "m1", Sender: "alice", RoutingKey: "game_logs.alice"}}
+	h(context.Background(), d)
+	for _, want := range []string{"queue=game_logs", "routing_key=game_logs.alice", "message_id=m1", "sender=alice", "ack=ack"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log %q is missing %s", logs.String(), want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	defaultGracePeriod = 5 * time.Second
+	defaultPrefetch    = 10
+)
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	gracePeriod time.Duration
+	retry       *RetryPolicy
+	prefetch    int
+	workers     int
+	// orderingKey holds the func(T) string passed to WithOrderingKey.
+	orderingKey any
+	logger      *slog.Logger
+	metrics     *Metrics
+	// versions lists the accepted schema versions; nil accepts any.
+	versions   []int
+	dedup      DedupStore
+	middleware []Middleware
+	decryption SecretKeys
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{
+		gracePeriod: defaultGracePeriod,
+		prefetch:    defaultPrefetch,
+		workers:     1,
+		logger:      slog.Default(),
+		metrics:     DefaultMetrics,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithGracePeriod sets how long Close waits for in-flight deliveries to be
+// handled before giving up and letting the broker requeue them.
+func WithGracePeriod(d time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.gracePeriod = d
+	}
+}
+
+// WithPrefetch sets how many unacknowledged deliveries the broker sends the
+// subscription at once. It defaults to 10 and should be at least the number
+// of workers, or some of them will sit idle.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n > 0 {
+			o.prefetch = n
+		}
+	}
+}
+
+// WithWorkers handles up to n deliveries concurrently. Without an ordering
+// key, deliveries are handled in no particular order.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// WithOrderingKey keeps deliveries that share a key in order: each key is
+// always handled by the same worker, while different keys are handled in
+// parallel. T must be the subscription's message type.
+func WithOrderingKey[T any](key func(T) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithLogger sets where the subscription logs what happens to each delivery.
+// Acks are logged at debug level, requeues at info and discards and decode
+// failures as warnings. It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithMetrics records the subscription's metrics in m instead of
+// DefaultMetrics.
+func WithMetrics(m *Metrics) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if m != nil {
+			o.metrics = m
+		}
+	}
+}
+
+// WithSchemaVersions discards messages whose schema version is not one of
+// versions instead of handing them to the handler.
+func WithSchemaVersions(versions ...int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.versions = versions
+	}
+}
+
+func (o subscribeOptions) acceptsVersion(version int) bool {
+	return o.versions == nil || slices.Contains(o.versions, version)
+}
@@ -1,11 +1,10 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
+	"log/slog"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -18,59 +17,90 @@ const (
 	NackDiscard
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	// Serialize the value to JSON
-	body, err := json.Marshal(val)
-	if err != nil {
-		return err
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
 	}
+}
 
-	// Publish the JSON message to the specified exchange and routing key
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        body,
-	})
+// Publish serializes val with codec and publishes it to the exchange with the
+// codec's content type, in an envelope with a fresh message ID, the current
+// time, val's type and the schema version. Bodies larger than the size limit
+// are refused with a *MessageTooLargeError before anything is sent.
+func Publish[T any](ch Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	return PublishContext(context.Background(), ch, codec, exchange, key, val, opts...)
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	// Serialize the value to GOB
-	var body []byte
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(val); err != nil {
+// PublishContext is Publish as part of the trace in ctx: the message carries
+// the W3C trace context of a producer span started under ctx, so that
+// subscribers' spans join the same trace.
+func PublishContext[T any](ctx context.Context, ch Publisher, codec Codec, exchange, key string, val T, opts ...PublishOption) error {
+	body, err := codec.Marshal(val)
+	if err != nil {
 		return err
 	}
-	body = buf.Bytes()
 
-	// Publish the GOB message to the specified exchange and routing key
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
 		Body:        body,
-	})
+	}
+	o := newEnvelope(&msg, val, opts)
+	if err := o.seal(exchange, key); err != nil {
+		o.metrics.inc(MetricPublishErrors, exchange)
+		return err
+	}
+	ctx, span := startPublishSpan(ctx, exchange, key, &msg)
+	err = ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	endSpan(span, err)
+	if err != nil {
+		o.metrics.inc(MetricPublishErrors, exchange)
+		return err
+	}
+	o.metrics.inc(MetricPublished, exchange)
+	o.metrics.add(MetricPayloadBytes, exchange, len(body))
+	o.metrics.add(MetricWireBytes, exchange, len(msg.Body))
+	return nil
+}
+
+func PublishJSON[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, JSON, exchange, key, val, opts...)
 }
 
+func PublishGob[T any](ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	return Publish(ch, Gob, exchange, key, val, opts...)
+}
+
+// DeclareAndBind declares queueName as opts describe, typically DurableQueue
+// or TransientQueue, and binds it to exchange with key.
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn Connection,
 	exchange,
 	queueName,
 	key string,
-	queueType bool, // true for durable, false for transient
-) (*amqp.Channel, amqp.Queue, error) {
+	opts QueueOptions,
+) (Channel, amqp.Queue, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, amqp.Queue{}, fmt.Errorf("declare queue %s: %w", queueName, err)
+	}
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
 
-	args := amqp.Table{}
-	args["x-dead-letter-exchange"] = "peril_dlx"
-
 	queue, err := ch.QueueDeclare(
 		queueName,
-		queueType,
-		!queueType,
-		!queueType, // exclusive should be false to make queue visible
+		opts.Durable,
+		opts.AutoDelete,
+		opts.Exclusive,
 		false,
-		args,
+		opts.Arguments(),
 	)
 	if err != nil {
 		return ch, amqp.Queue{}, err
@@ -89,110 +119,248 @@ func DeclareAndBind(
 	return ch, queue, nil
 }
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// Subscribe consumes messages from queueName until ctx is cancelled or the
+// returned subscription is closed. Each message is decoded with the codec
+// registered for its content type; codec is used for messages without one.
+func Subscribe[T any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
 	exchange,
 	queueName,
 	key string,
-	queueType bool, // true for durable, false for transient
+	queueOpts QueueOptions,
 	handler func(T) AckType,
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeContext(ctx, conn, codec, exchange, queueName, key, queueOpts, func(_ context.Context, val T) AckType {
+		return handler(val)
+	}, opts...)
+}
+
+// SubscribeContext is Subscribe for handlers that take part in tracing. Each
+// delivery is handled in a consumer span that continues the publisher's trace,
+// and the handler's context carries that span so anything it publishes with
+// PublishContext joins the trace too.
+func SubscribeContext[T any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
+	exchange,
+	queueName,
+	key string,
+	queueOpts QueueOptions,
+	handler func(context.Context, T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeMessage(ctx, conn, codec, exchange, queueName, key, queueOpts, func(ctx context.Context, msg Message[T]) AckType {
+		return handler(ctx, msg.Body)
+	}, opts...)
+}
+
+// SubscribeMessage is SubscribeContext for handlers that need the envelope
+// as well as the payload. Messages whose schema version the subscription
+// does not accept are discarded before reaching the handler.
+func SubscribeMessage[T any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
+	exchange,
+	queueName,
+	key string,
+	queueOpts QueueOptions,
+	handler func(context.Context, Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	sub, err := newMessageSubscription(codec, queueName, handler, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = ch.Qos(10, 0, false)
-	if err != nil {
-		return err
+	if err := sub.run(ctx, conn, exchange, key, queueOpts); err != nil {
+		return nil, err
 	}
-	msgs, err := ch.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return err
+	return sub, nil
+}
+
+// newMessageSubscription sets up the handling of deliveries from queueName
+// for SubscribeMessage, leaving it to the caller to start consuming.
+func newMessageSubscription[T any](codec Codec, queueName string, handler func(context.Context, Message[T]) AckType, opts []SubscribeOption) (*Subscription, error) {
+	sub := newSubscription(queueName, newSubscribeOptions(opts))
+	var orderingKey func(T) string
+	if sub.opts.orderingKey != nil {
+		fn, ok := sub.opts.orderingKey.(func(T) string)
+		if !ok {
+			var zero T
+			return nil, fmt.Errorf("ordering key for queue %s must be a func(%T) string", queueName, zero)
+		}
+		orderingKey = fn
 	}
+	var retries *retrier
+	if sub.opts.retry != nil {
+		retries = newRetrier(*sub.opts.retry, queueName)
+	}
+	logger := sub.opts.logger.With("queue", queueName)
+	metrics := sub.opts.metrics
+	handle := chain(func(ctx context.Context, d *Delivery) AckType {
+		return handler(ctx, Message[T]{Envelope: d.Envelope, Body: d.Body.(T)})
+	}, append([]Middleware{Recover(sub.opts.logger)}, sub.opts.middleware...))
+
+	decodeWith(sub, codec, func(ch Channel, msg amqp.Delivery, envelope Envelope, data T) (string, func()) {
+		var order string
+		switch {
+		case orderingKey != nil:
+			order = orderingKey(data)
+		case sub.opts.dedup != nil:
+			// Copies of a message share its ID, so handling them on the
+			// same worker stops two from getting past the duplicate check
+			// at once.
+			order = envelope.ID
+		}
+		return order, func() {
+			msgLogger := logger.With("routing_key", msg.RoutingKey, "message_id", envelope.ID)
+			dedup := sub.opts.dedup
+			if envelope.ID == "" {
+				dedup = nil
+			}
+			if dedup != nil {
+				seen, err := dedup.Seen(dedupKey(queueName, envelope.ID))
+				if err != nil {
+					msgLogger.Warn("could not check for duplicate message", "error", err)
+				} else if seen {
+					metrics.inc(MetricDuplicates, queueName)
+					msgLogger.Debug("skipping duplicate message")
+					msg.Ack(false)
+					return
+				}
+			}
+
+			spanCtx, span := startConsumeSpan(queueName, msg)
+			start := time.Now()
+			ackType := handle(spanCtx, &Delivery{Envelope: envelope, Queue: queueName, Body: data, Raw: msg})
+			metrics.observe(queueName, time.Since(start))
+			endConsumeSpan(span, ackType)
 
-	go func() {
-		for msg := range msgs {
-			var data T
-			if err := json.Unmarshal(msg.Body, &data); err != nil {
+			if dedup != nil && ackType != NackRequeue {
+				if err := dedup.Mark(dedupKey(queueName, envelope.ID)); err != nil {
+					msgLogger.Warn("could not record handled message", "error", err)
+				}
+			}
+			settle(ch, msg, ackType, retries, msgLogger, metrics, queueName)
+		}
+	})
+	return sub, nil
+}
+
+// decodeWith sets the subscription up to decode each delivery before passing
+// it to dispatch. Deliveries with a schema version the subscription doesn't
+// accept, or that don't decode, are discarded.
+func decodeWith[T any](sub *Subscription, codec Codec, dispatch func(ch Channel, msg amqp.Delivery, envelope Envelope, data T) (string, func())) {
+	queueName := sub.queue
+	logger := sub.opts.logger.With("queue", queueName)
+	metrics := sub.opts.metrics
+	sub.prepare = func(ch Channel, msg amqp.Delivery) (string, func()) {
+		metrics.inc(MetricConsumed, queueName)
+		envelope := ParseEnvelope(msg)
+		if !sub.opts.acceptsVersion(envelope.SchemaVersion) {
+			return "", func() {
+				metrics.inc(MetricNackedDiscard, queueName)
+				logger.Warn("discarding message with unsupported schema version",
+					"routing_key", msg.RoutingKey, "type", envelope.Type, "schema_version", envelope.SchemaVersion)
 				msg.Nack(false, false)
-				continue
 			}
-			ackType := handler(data)
-			switch ackType {
-			case Ack:
-				msg.Ack(false)
-				fmt.Println("Acked message successfully")
-			case NackRequeue:
-				msg.Nack(false, true)
-				fmt.Println("Nacked message and requeued")
-			case NackDiscard:
+		}
+		plain, err := decrypt(msg, sub.opts.decryption)
+		if err != nil {
+			return "", func() {
+				metrics.inc(MetricDecodeFailures, queueName)
+				metrics.inc(MetricNackedDiscard, queueName)
+				logger.Warn("discarding message that could not be decrypted",
+					"routing_key", msg.RoutingKey, "error", err)
 				msg.Nack(false, false)
-				fmt.Println("Nacked message and discarded")
 			}
 		}
-	}()
+		data, err := decode[T](plain, codec)
+		if err != nil {
+			return "", func() {
+				metrics.inc(MetricDecodeFailures, queueName)
+				metrics.inc(MetricNackedDiscard, queueName)
+				logger.Warn("discarding message that could not be decoded",
+					"routing_key", msg.RoutingKey, "content_type", msg.ContentType, "error", err)
+				msg.Nack(false, false)
+			}
+		}
+		return dispatch(ch, msg, envelope, data)
+	}
+}
 
-	return nil
+// settle acknowledges msg as its handler asked, sending requeues through the
+// retry policy if there is one.
+func settle(ch Channel, msg amqp.Delivery, ackType AckType, retries *retrier, logger *slog.Logger, metrics *Metrics, queue string) {
+	switch ackType {
+	case Ack:
+		metrics.inc(MetricAcked, queue)
+		msg.Ack(false)
+		logger.Debug("acked message")
+	case NackRequeue:
+		metrics.inc(MetricNackedRequeue, queue)
+		if retries != nil {
+			retries.retry(ch, msg, "handler requested requeue")
+			logger.Info("nacked message and scheduled a retry")
+			return
+		}
+		msg.Nack(false, true)
+		logger.Info("nacked message and requeued it")
+	case NackDiscard:
+		metrics.inc(MetricNackedDiscard, queue)
+		msg.Nack(false, false)
+		logger.Warn("nacked message and discarded it")
+	}
 }
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType bool, // true for durable, false for transient
-	handler func(T) AckType,
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return err
+func decode[T any](msg amqp.Delivery, fallback Codec) (T, error) {
+	var data T
+	codec := fallback
+	if msg.ContentType != "" {
+		c, ok := CodecFor(msg.ContentType)
+		if !ok {
+			return data, fmt.Errorf("no codec registered for content type %q", msg.ContentType)
+		}
+		codec = c
 	}
-	err = ch.Qos(10, 0, false)
+	body, err := decompress(msg.Body, msg.ContentEncoding)
 	if err != nil {
-		return err
-	}
-	msgs, err := ch.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return err
+		return data, err
 	}
+	err = codec.Unmarshal(body, &data)
+	return data, err
+}
 
-	go func() {
-		for msg := range msgs {
-			var data T
-			if err := gob.NewDecoder(bytes.NewReader(msg.Body)).Decode(&data); err != nil {
-				msg.Nack(false, false)
-				continue
-			}
-			ackType := handler(data)
-			switch ackType {
-			case Ack:
-				msg.Ack(false)
-				fmt.Println("Acked message successfully")
-			case NackRequeue:
-				msg.Nack(false, true)
-				fmt.Println("Nacked message and requeued")
-			case NackDiscard:
-				msg.Nack(false, false)
-				fmt.Println("Nacked message and discarded")
-			}
-		}
-	}()
+// SubscribeJSON is Subscribe for queues whose messages are JSON unless they
+// say otherwise.
+func SubscribeJSON[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueOpts QueueOptions,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, conn, JSON, exchange, queueName, key, queueOpts, handler, opts...)
+}
 
-	return nil
+// SubscribeGob is Subscribe for queues whose messages are Gob unless they
+// say otherwise.
+func SubscribeGob[T any](
+	ctx context.Context,
+	conn Connection,
+	exchange,
+	queueName,
+	key string,
+	queueOpts QueueOptions,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, conn, Gob, exchange, queueName, key, queueOpts, handler, opts...)
 }
@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueType is the kind of queue RabbitMQ declares, set by x-queue-type.
+type QueueType string
+
+const (
+	QueueClassic QueueType = "classic"
+	// QueueQuorum is replicated across the cluster and survives the loss
+	// of a node. Quorum queues must be durable and shared.
+	QueueQuorum QueueType = "quorum"
+	// QueueStream keeps messages after they are consumed; see
+	// SubscribeStream.
+	QueueStream QueueType = "stream"
+)
+
+// Overflow is what a queue at its maximum length does with a new message.
+type Overflow string
+
+const (
+	// OverflowDropHead dead-letters the oldest message to make room. It is
+	// RabbitMQ's default.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish refuses the new message, nacking it to
+	// publishers that use confirms.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX refuses the new message and dead-letters it.
+	// Classic queues only.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOptions describes how a queue is declared.
+type QueueOptions struct {
+	// Type defaults to QueueClassic.
+	Type       QueueType
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	// MessageTTL, if positive, dead-letters messages that have waited this
+	// long.
+	MessageTTL time.Duration
+	// MaxLength, if positive, bounds the number of ready messages, with
+	// Overflow saying what happens to the rest.
+	MaxLength int
+	Overflow  Overflow
+	// SingleActiveConsumer delivers to one consumer at a time, the others
+	// standing by in case it goes away, so messages are handled in order.
+	SingleActiveConsumer bool
+	DeadLetterExchange   string
+	// DeadLetterRoutingKey replaces the routing key of dead-lettered
+	// messages; by default they keep their own.
+	DeadLetterRoutingKey string
+}
+
+var (
+	// DurableQueue is a classic queue shared by its consumers that survives
+	// broker restarts, dead-lettering to DeadLetterExchange.
+	DurableQueue = QueueOptions{Durable: true, DeadLetterExchange: DeadLetterExchange}
+	// TransientQueue is a classic queue private to one connection and
+	// deleted with its last consumer, dead-lettering to DeadLetterExchange.
+	TransientQueue = QueueOptions{AutoDelete: true, Exclusive: true, DeadLetterExchange: DeadLetterExchange}
+)
+
+// Arguments returns the queue's declare arguments.
+func (o QueueOptions) Arguments() amqp.Table {
+	args := amqp.Table{}
+	if o.Type != "" && o.Type != QueueClassic {
+		args["x-queue-type"] = string(o.Type)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = string(o.Overflow)
+	}
+	if o.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if o.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	if o.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = o.DeadLetterRoutingKey
+	}
+	return args
+}
+
+// Validate reports combinations of options the broker would refuse.
+func (o QueueOptions) Validate() error {
+	var errs []error
+	switch o.Type {
+	case "", QueueClassic:
+	case QueueQuorum, QueueStream:
+		if !o.Durable || o.AutoDelete || o.Exclusive {
+			errs = append(errs, fmt.Errorf("%s queues must be durable, not auto-delete or exclusive", o.Type))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown queue type %q", o.Type))
+	}
+	switch o.Overflow {
+	case "", OverflowDropHead, OverflowRejectPublish:
+	case OverflowRejectPublishDLX:
+		if o.Type == QueueQuorum {
+			errs = append(errs, fmt.Errorf("quorum queues don't support overflow %s", o.Overflow))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown overflow behaviour %q", o.Overflow))
+	}
+	if o.Overflow != "" && o.MaxLength <= 0 {
+		errs = append(errs, errors.New("overflow needs a max length"))
+	}
+	if o.DeadLetterRoutingKey != "" && o.DeadLetterExchange == "" {
+		errs = append(errs, errors.New("a dead-letter routing key needs a dead-letter exchange"))
+	}
+	if o.Type == QueueStream && (o.MessageTTL > 0 || o.MaxLength > 0 || o.SingleActiveConsumer || o.DeadLetterExchange != "") {
+		errs = append(errs, errors.New("streams don't support message TTL, max length, single active consumer or dead-lettering"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid queue options: %w", err)
+	}
+	return nil
+}
+
+// Spec is the topology spec of a queue called name declared with o.
+func (o QueueOptions) Spec(name string) QueueSpec {
+	return QueueSpec{
+		Name:       name,
+		Durable:    o.Durable,
+		AutoDelete: o.AutoDelete,
+		Exclusive:  o.Exclusive,
+		Args:       o.Arguments(),
+	}
+}
@@ -0,0 +1,213 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DeadLetterExchange = "peril_dlx"
+
+	HeaderRetryAttempt       = "x-retry-attempt"
+	HeaderFailureReason      = "x-failure-reason"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderOriginalQueue      = "x-original-queue"
+)
+
+// RetryPolicy turns NackRequeue into delayed redelivery. Each retry waits in
+// a delay queue whose message TTL dead-letters the message back to the
+// original queue. Once MaxAttempts deliveries have failed the message is
+// published to DeadLetterExchange with the failure reason in its headers.
+type RetryPolicy struct {
+	MaxAttempts        int
+	InitialDelay       time.Duration
+	Multiplier         float64
+	MaxDelay           time.Duration
+	DeadLetterExchange string
+}
+
+// WithRetry enables delayed redelivery for the subscription. Zero fields of
+// policy take the defaults: 5 attempts, 1s doubling up to 1m, and peril_dlx.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 5
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Minute
+	}
+	if policy.DeadLetterExchange == "" {
+		policy.DeadLetterExchange = DeadLetterExchange
+	}
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+// Delay returns how long to wait before the given retry, counting from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// retrier schedules redeliveries for one subscription.
+type retrier struct {
+	policy RetryPolicy
+	queue  string
+
+	mu         sync.Mutex
+	declaredOn Channel
+	declared   map[string]bool
+}
+
+func newRetrier(policy RetryPolicy, queue string) *retrier {
+	return &retrier{
+		policy: policy,
+		queue:  queue,
+	}
+}
+
+// retry settles a delivery its handler asked to requeue, either by parking a
+// copy in a delay queue or, once attempts are exhausted, by publishing it to
+// the dead-letter exchange. The original is acked only once its copy has been
+// published; otherwise it is requeued as before.
+func (r *retrier) retry(ch Channel, msg amqp.Delivery, reason string) {
+	attempt := int(headerInt(msg.Headers, HeaderRetryAttempt)) + 1
+	pub := republish(msg)
+	if _, ok := pub.Headers[HeaderOriginalExchange]; !ok {
+		pub.Headers[HeaderOriginalExchange] = msg.Exchange
+		pub.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	}
+	pub.Headers[HeaderOriginalQueue] = r.queue
+	pub.Headers[HeaderRetryAttempt] = int64(attempt)
+
+	var err error
+	if attempt < r.policy.MaxAttempts {
+		err = r.delay(ch, pub, r.policy.Delay(attempt))
+	} else {
+		err = r.park(ch, pub, fmt.Sprintf("%s after %d attempts", reason, attempt))
+	}
+	if err != nil {
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// delay parks pub in the delay queue for delay. Expired messages are
+// dead-lettered through the default exchange straight back to the original
+// queue, and the delay queue deletes itself once it has been idle for a while.
+func (r *retrier) delay(ch Channel, pub amqp.Publishing, delay time.Duration) error {
+	name := fmt.Sprintf("%s.retry.%d", r.queue, delay.Milliseconds())
+	err := r.declareOnce(ch, name, func() error {
+		_, err := ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": r.queue,
+			"x-expires":                 (delay + time.Minute).Milliseconds(),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return ch.PublishWithContext(context.Background(), "", name, false, false, pub)
+}
+
+// park gives up on pub and publishes it to the dead-letter exchange under its
+// original routing key.
+func (r *retrier) park(ch Channel, pub amqp.Publishing, reason string) error {
+	dlx := r.policy.DeadLetterExchange
+	// Publishing to a missing exchange would close the consumer's channel.
+	err := r.declareOnce(ch, dlx, func() error {
+		return ch.ExchangeDeclare(dlx, amqp.ExchangeFanout, true, false, false, false, nil)
+	})
+	if err != nil {
+		return err
+	}
+	pub.Headers[HeaderFailureReason] = reason
+	key, _ := pub.Headers[HeaderOriginalRoutingKey].(string)
+	return ch.PublishWithContext(context.Background(), dlx, key, false, false, pub)
+}
+
+// declareOnce runs declare the first time name is needed on ch.
+func (r *retrier) declareOnce(ch Channel, name string, declare func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.declaredOn != ch {
+		// A new channel means a new connection, possibly to a restarted
+		// broker, so nothing can be assumed to exist.
+		r.declaredOn = ch
+		r.declared = map[string]bool{}
+	}
+	if r.declared[name] {
+		return nil
+	}
+	if err := declare(); err != nil {
+		return err
+	}
+	r.declared[name] = true
+	return nil
+}
+
+func republish(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// headerInt reads an integer header whatever integer type it arrived as.
+func headerInt(headers amqp.Table, key string) int64 {
+	switch v := headers[key].(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
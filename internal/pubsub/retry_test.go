@@ -0,0 +1,92 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := p.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+// TestRetryToParking fails a message every time it is delivered and follows
+// it through the delay queues to the dead-letter exchange.
+func TestRetryToParking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	for _, ex := range []struct{ name, kind string }{{"peril_topic", amqp.ExchangeTopic}, {DeadLetterExchange, amqp.ExchangeFanout}} {
+		if err := ch.ExchangeDeclare(ex.name, ex.kind, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ch.QueueDeclare("parked", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("parked", "", DeadLetterExchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := make(chan int64, 8)
+	sub, err := SubscribeMessage(ctx, conn, JSON, "peril_topic", "moves", "moves.*", QueueOptions{Durable: true},
+		func(context.Context, Message[string]) AckType { return NackRequeue },
+		WithRetry(RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond}),
+		WithMiddleware(func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, d *Delivery) AckType {
+				attempts <- headerInt(d.Raw.Headers, HeaderRetryAttempt)
+				return next(ctx, d)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := PublishJSON(ch, "peril_topic", "moves.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+
+	for want := int64(0); want < 3; want++ {
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Fatalf("delivery %d has %s %d", want+1, HeaderRetryAttempt, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d never came", want+1)
+		}
+	}
+
+	d := getEventually(t, ch, "parked")
+	for header, want := range map[string]any{
+		HeaderRetryAttempt:       int64(3),
+		HeaderFailureReason:      "handler requested requeue after 3 attempts",
+		HeaderOriginalExchange:   "peril_topic",
+		HeaderOriginalRoutingKey: "moves.alice",
+		HeaderOriginalQueue:      "moves",
+	} {
+		if got := d.Headers[header]; got != want {
+			t.Errorf("parked message has %s %v, want %v", header, got, want)
+		}
+	}
+	if d.RoutingKey != "moves.alice" {
+		t.Errorf("parked under %q, want moves.alice", d.RoutingKey)
+	}
+	if body, err := Decode[string](d); err != nil || body != "move" {
+		t.Errorf("parked message is %q (%v), want move", body, err)
+	}
+	select {
+	case n := <-attempts:
+		t.Errorf("delivered again, attempt %d, after being parked", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,284 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderRPCError carries the error a server's handler returned instead of a
+// reply.
+const HeaderRPCError = "x-rpc-error"
+
+// ErrNoResponder is returned by Call when no queue is bound to receive the
+// request, which usually means no server has ever served it. Once one has,
+// requests wait in its queue until a server answers or they expire.
+var ErrNoResponder = errors.New("pubsub: no responder for request")
+
+// RemoteError is an error returned by the handler serving a request.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote error: " + e.Message
+}
+
+// RPCClient sends requests and routes replies back to their callers by
+// correlation ID. Replies arrive on an exclusive, server-named queue that
+// lives as long as the client's channel; after a disconnect the next call
+// opens a new one.
+type RPCClient struct {
+	conn    Connection
+	codec   Codec
+	timeout time.Duration
+
+	mu         sync.Mutex
+	ch         Channel
+	replyQueue string
+	pending    map[string]chan amqp.Delivery
+}
+
+// NewRPCClient encodes requests with codec. timeout bounds each call when
+// the caller's context has no deadline of its own; requests nobody has
+// picked up by then expire.
+func NewRPCClient(conn Connection, codec Codec, timeout time.Duration) *RPCClient {
+	return &RPCClient{
+		conn:    conn,
+		codec:   codec,
+		timeout: timeout,
+		pending: map[string]chan amqp.Delivery{},
+	}
+}
+
+// Call sends req to exchange with routing key key and waits for the reply.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	id := newMessageID()
+	replies := make(chan amqp.Delivery, 1)
+	ch, replyQueue, err := c.register(id, replies)
+	if err != nil {
+		return resp, err
+	}
+	defer c.unregister(id)
+
+	opts = append(opts, WithCorrelationID(id), withReplyTo(replyQueue))
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, withExpiration(time.Until(deadline)))
+	}
+	if err := PublishContext(ctx, mandatoryPublisher{ch}, c.codec, exchange, key, req, opts...); err != nil {
+		c.reset(ch)
+		return resp, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return resp, ErrNoResponder
+		}
+		if msg, ok := reply.Headers[HeaderRPCError].(string); ok {
+			return resp, &RemoteError{Message: msg}
+		}
+		return decode[Resp](reply, c.codec)
+	case <-ctx.Done():
+		return resp, fmt.Errorf("pubsub: waiting for reply from %s: %w", key, ctx.Err())
+	}
+}
+
+// Close closes the client's channel, deleting its reply queue.
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	ch := c.ch
+	c.mu.Unlock()
+	c.reset(ch)
+	return nil
+}
+
+func (c *RPCClient) register(id string, replies chan amqp.Delivery) (Channel, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.open(); err != nil {
+		return nil, "", err
+	}
+	c.pending[id] = replies
+	return c.ch, c.replyQueue, nil
+}
+
+func (c *RPCClient) unregister(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *RPCClient) open() error {
+	if c.ch != nil {
+		return nil
+	}
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return err
+	}
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	msgs, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	c.ch = ch
+	c.replyQueue = queue.Name
+	go c.receive(ch, msgs, returns)
+	return nil
+}
+
+// receive hands replies to the calls waiting for them. Returned requests
+// fail their call straight away rather than leaving it to time out.
+func (c *RPCClient) receive(ch Channel, msgs <-chan amqp.Delivery, returns chan amqp.Return) {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				c.reset(ch)
+				return
+			}
+			c.deliver(msg.CorrelationId, msg, true)
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.deliver(ret.CorrelationId, amqp.Delivery{}, false)
+		}
+	}
+}
+
+func (c *RPCClient) deliver(id string, msg amqp.Delivery, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replies, found := c.pending[id]
+	if !found {
+		// The caller has given up already.
+		return
+	}
+	delete(c.pending, id)
+	if ok {
+		replies <- msg
+	} else {
+		close(replies)
+	}
+}
+
+// reset abandons ch if it is still the client's channel.
+func (c *RPCClient) reset(ch Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch == nil || c.ch != ch {
+		return
+	}
+	c.ch.Close()
+	c.ch = nil
+	c.replyQueue = ""
+}
+
+// mandatoryPublisher publishes with the mandatory flag so requests nobody
+// is listening for come back as returns.
+type mandatoryPublisher struct {
+	ch Publisher
+}
+
+func (p mandatoryPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return p.ch.PublishWithContext(ctx, exchange, key, true, immediate, msg)
+}
+
+func withReplyTo(queue string) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.ReplyTo = queue
+	}
+}
+
+func withExpiration(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Expiration = strconv.FormatInt(max(d.Milliseconds(), 1), 10)
+	}
+}
+
+// Serve answers requests arriving on queueName, bound to exchange with key,
+// by replying with whatever handler returns. Requests are acked whether or
+// not the handler fails, since its error is sent back to the caller.
+//
+// The queue is durable and shared, so any number of servers can answer the
+// same requests between them. Only the callers' reply queues are exclusive.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
+	exchange,
+	queueName,
+	key string,
+	handler func(context.Context, Message[Req]) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	replies, closeReplies, err := publisherFor(conn)
+	if err != nil {
+		return nil, err
+	}
+	// Replies are counted with the requests they answer.
+	metrics := newSubscribeOptions(opts).metrics
+	sub, err := SubscribeMessage(ctx, conn, codec, exchange, queueName, key, DurableQueue, func(ctx context.Context, req Message[Req]) AckType {
+		resp, err := handler(ctx, req)
+		if req.ReplyTo == "" {
+			return Ack
+		}
+		replyOpts := []PublishOption{WithCorrelationID(req.CorrelationID), WithPublishMetrics(metrics)}
+		if err != nil {
+			replyOpts = append(replyOpts, withRPCError(err))
+		}
+		if err := PublishContext(ctx, replies, codec, "", req.ReplyTo, resp, replyOpts...); err != nil {
+			return NackDiscard
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		closeReplies()
+		return nil, err
+	}
+	go func() {
+		<-sub.Done()
+		closeReplies()
+	}()
+	return sub, nil
+}
+
+func withRPCError(err error) PublishOption {
+	return func(o *publishOptions) {
+		o.msg.Headers[HeaderRPCError] = err.Error()
+	}
+}
+
+// publisherFor returns something to publish on conn with: the connection
+// itself if it can publish, or else a channel of its own.
+func publisherFor(conn Connection) (Publisher, func(), error) {
+	if p, ok := conn.(Publisher); ok {
+		return p, func() {}, nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ch, func() { ch.Close() }, nil
+}
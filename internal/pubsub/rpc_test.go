@@ -0,0 +1,43 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestServeShared serves the same requests from two connections, as two
+// servers would, and checks both can and that callers are answered.
+func TestServeShared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	if err := channel(t, conn).ExchangeDeclare("peril_direct", "direct", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+		sub, err := Serve(ctx, dial(t, broker), JSON, "peril_direct", "echo", "echo",
+			func(_ context.Context, req Message[string]) (string, error) {
+				return name + ": " + req.Body, nil
+			})
+		if err != nil {
+			t.Fatalf("serving from the %s connection: %v", name, err)
+		}
+		defer sub.Close()
+	}
+
+	client := NewRPCClient(conn, JSON, time.Second)
+	defer client.Close()
+	for i := 0; i < 4; i++ {
+		resp, err := Call[string, string](ctx, client, "peril_direct", "echo", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != "first: hello" && resp != "second: hello" {
+			t.Errorf("got %q, want hello answered by either server", resp)
+		}
+	}
+}
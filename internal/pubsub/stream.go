@@ -0,0 +1,170 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderStreamOffset carries a stream message's offset on delivery, and the
+// offset to start from when consuming a stream.
+const HeaderStreamOffset = "x-stream-offset"
+
+// StreamOffset says where in a stream a consumer starts reading.
+type StreamOffset struct {
+	arg any
+}
+
+var (
+	// StreamFirst starts from the oldest message the stream still has.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts from the last chunk of messages written.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext starts with the next message published.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamOffsetAt starts from the message at offset n.
+func StreamOffsetAt(n int64) StreamOffset {
+	return StreamOffset{n}
+}
+
+// StreamOffsetSince starts from the first message written at or after t.
+// Streams keep time in seconds, so up to a second more may be read.
+func StreamOffsetSince(t time.Time) StreamOffset {
+	return StreamOffset{t.UTC()}
+}
+
+// ParseStreamOffset reads an offset as written on a command line: first,
+// last, next, a numeric offset, a duration such as 10m meaning that long ago,
+// or an RFC 3339 time.
+func ParseStreamOffset(s string) (StreamOffset, error) {
+	switch s {
+	case "first":
+		return StreamFirst, nil
+	case "last":
+		return StreamLast, nil
+	case "next":
+		return StreamNext, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return StreamOffsetAt(n), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return StreamOffsetSince(time.Now().Add(-d)), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return StreamOffsetSince(t), nil
+	}
+	return StreamOffset{}, fmt.Errorf("invalid stream offset %q: want first, last, next, an offset, a duration or an RFC 3339 time", s)
+}
+
+func (o StreamOffset) String() string {
+	switch arg := o.arg.(type) {
+	case time.Time:
+		return arg.Format(time.RFC3339)
+	case nil:
+		return "next"
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// StreamQueue is the spec of a stream called name. Streams keep messages
+// after they are consumed, so maxAge, if positive, bounds how long they are
+// kept; otherwise they are kept until the broker's size limits apply.
+func StreamQueue(name string, maxAge time.Duration) QueueSpec {
+	spec := QueueOptions{Type: QueueStream, Durable: true}.Spec(name)
+	if maxAge > 0 {
+		spec.Args["x-max-age"] = fmt.Sprintf("%ds", int64(maxAge.Seconds()))
+	}
+	return spec
+}
+
+// SubscribeStream reads the stream queueName from offset onwards, handling
+// messages as SubscribeMessage does, until ctx is cancelled or the returned
+// subscription is closed. The stream must already exist, usually declared
+// with the rest of the topology from StreamQueue. Each message's offset is
+// in its envelope.
+//
+// Reading a stream doesn't consume it: settling a message only lets the
+// broker send more, so WithRetry does not apply and requeued messages are
+// not redelivered. After a reconnect reading resumes after the last message
+// handled.
+func SubscribeStream[T any](
+	ctx context.Context,
+	conn Connection,
+	codec Codec,
+	queueName string,
+	offset StreamOffset,
+	handler func(context.Context, Message[T]) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	opts = append(opts, func(o *subscribeOptions) {
+		o.retry = nil
+	})
+	sub, err := newMessageSubscription(codec, queueName, handler, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := sub.runStream(ctx, conn, offset); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// runStream starts consuming the subscription's stream from offset, and
+// from after the last message handled whenever a managed connection starts
+// it again.
+func (s *Subscription) runStream(ctx context.Context, conn Connection, offset StreamOffset) error {
+	var mu sync.Mutex
+	next := offset
+	prepare := s.prepare
+	s.prepare = func(ch Channel, msg amqp.Delivery) (string, func()) {
+		key, handle := prepare(ch, msg)
+		if _, ok := msg.Headers[HeaderStreamOffset]; !ok {
+			return key, handle
+		}
+		n := headerInt(msg.Headers, HeaderStreamOffset)
+		return key, func() {
+			handle()
+			mu.Lock()
+			defer mu.Unlock()
+			// Workers may finish out of order.
+			if last, ok := next.arg.(int64); !ok || n+1 > last {
+				next = StreamOffsetAt(n + 1)
+			}
+		}
+	}
+
+	s.consume = func(conn Connection, tag string) (Channel, <-chan amqp.Delivery, error) {
+		ch, err := conn.Channel()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Streams need a prefetch count to consume at all.
+		err = ch.Qos(s.opts.prefetch, 0, false)
+		if err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		mu.Lock()
+		from := next
+		mu.Unlock()
+		args := amqp.Table{}
+		if from.arg != nil {
+			args[HeaderStreamOffset] = from.arg
+		}
+		msgs, err := ch.Consume(s.queue, tag, false, false, false, false, args)
+		if err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		return ch, msgs, nil
+	}
+	return s.begin(ctx, conn)
+}
@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreamOffset(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"first", "first"},
+		{"last", "last"},
+		{"next", "next"},
+		{"0", int64(0)},
+		{"42", int64(42)},
+		{"2024-01-02T03:04:05Z", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"2024-01-02T03:04:05+02:00", time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{"-1", nil},
+		{"0s", nil},
+		{"-10m", nil},
+		{"yesterday", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseStreamOffset(tt.in)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.arg != tt.want {
+				t.Errorf("got %#v, want %#v", got.arg, tt.want)
+			}
+		})
+	}
+
+	// Durations count back from now.
+	got, err := ParseStreamOffset("10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	since, ok := got.arg.(time.Time)
+	if ago := time.Since(since); !ok || ago < 10*time.Minute || ago > 11*time.Minute {
+		t.Errorf("10m gave %v, want ten minutes ago", got)
+	}
+}
+
+func TestStreamCursor(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	q := &memQueue{stream: true}
+	for i := 0; i < 3; i++ {
+		q.log = append(q.log, &memMessage{offset: int64(i), storedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	tests := []struct {
+		name string
+		arg  any
+		want int64
+	}{
+		{"no offset", nil, 3},
+		{"first", "first", 0},
+		{"last", "last", 2},
+		{"next", "next", 3},
+		{"numeric", int64(1), 1},
+		{"other integer types", int32(2), 2},
+		{"past the end", int64(7), 3},
+		{"negative", -2, 0},
+		{"timestamp", start.Add(time.Second), 1},
+		{"timestamp within a second", start.Add(1500 * time.Millisecond), 1},
+		{"timestamp before the stream", start.Add(-time.Hour), 0},
+		{"timestamp after the stream", start.Add(time.Hour), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := q.streamCursor(tt.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+	for _, arg := range []any{"middle", 1.5} {
+		if _, err := q.streamCursor(arg); err == nil {
+			t.Errorf("offset %#v accepted", arg)
+		}
+	}
+
+	empty := &memQueue{stream: true}
+	if got, _ := empty.streamCursor("last"); got != 0 {
+		t.Errorf("last of an empty stream is %d, want 0", got)
+	}
+}
+
+// TestSubscribeStream reads a stream of five messages, the last two written
+// a second after the rest, from each kind of offset. Every reader publishes
+// a marker of its own once it has started, and reads up to it.
+func TestSubscribeStream(t *testing.T) {
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	spec := StreamQueue("log", 0)
+	if _, err := ch.QueueDeclare(spec.Name, spec.Durable, false, false, false, spec.Arguments()); err != nil {
+		t.Fatal(err)
+	}
+	write := func(body string) {
+		t.Helper()
+		if err := PublishJSON(ch, "", "log", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		write(strconv.Itoa(i))
+	}
+	// Streams keep time in seconds, so wait for the next one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	since := time.Now()
+	for i := 3; i < 5; i++ {
+		write(strconv.Itoa(i))
+	}
+
+	tests := []struct {
+		name   string
+		offset StreamOffset
+		want   []int
+	}{
+		// Last goes first, before any marker is written after message 4.
+		{"last", StreamLast, []int{4}},
+		{"first", StreamFirst, []int{0, 1, 2, 3, 4}},
+		{"next", StreamNext, nil},
+		{"numeric", StreamOffsetAt(2), []int{2, 3, 4}},
+		{"timestamp", StreamOffsetSince(since), []int{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			marker := "end " + tt.name
+			read := make(chan Message[string], 16)
+			sub, err := SubscribeStream(ctx, conn, JSON, "log", tt.offset,
+				func(_ context.Context, msg Message[string]) AckType {
+					read <- msg
+					return Ack
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			write(marker)
+
+			var got []int
+			for {
+				var msg Message[string]
+				select {
+				case msg = <-read:
+				case <-time.After(time.Second):
+					t.Fatalf("never read %q; read %v", marker, got)
+				}
+				if msg.Body == marker {
+					break
+				}
+				if strings.HasPrefix(msg.Body, "end ") {
+					continue
+				}
+				n, _ := strconv.Atoi(msg.Body)
+				if msg.StreamOffset != int64(n) {
+					t.Errorf("message %d read at offset %d", n, msg.StreamOffset)
+				}
+				got = append(got, n)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDrainTimeout is returned by Subscription.Close when in-flight
+// deliveries were still being handled after the grace period.
+var ErrDrainTimeout = errors.New("pubsub: grace period expired before in-flight deliveries were handled")
+
+var consumerSeq atomic.Uint64
+
+// Subscription is a running consumer. It stops when Close is called or the
+// context it was created with is cancelled.
+type Subscription struct {
+	queue string
+	opts  subscribeOptions
+
+	// consume declares the queue and starts a consumer tagged tag on conn.
+	consume func(conn Connection, tag string) (Channel, <-chan amqp.Delivery, error)
+	// prepare decodes a delivery and returns its ordering key along with
+	// the work of handling and settling it.
+	prepare func(Channel, amqp.Delivery) (key string, handle func())
+	// flush, if set, runs after the last delivery from a channel has been
+	// handled, to settle anything prepare held back.
+	flush func()
+	// unregister stops a managed connection from resuming the subscription.
+	// It is nil for plain connections, whose subscriptions end with them.
+	unregister func()
+
+	mu      sync.Mutex
+	ch      Channel
+	tag     string
+	closing bool
+
+	consumers sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
+	doneOnce  sync.Once
+	err       error
+}
+
+func newSubscription(queue string, opts subscribeOptions) *Subscription {
+	return &Subscription{
+		queue: queue,
+		opts:  opts,
+		done:  make(chan struct{}),
+	}
+}
+
+// Queue returns the name of the queue being consumed.
+func (s *Subscription) Queue() string {
+	return s.queue
+}
+
+// Done is closed once the subscription has stopped for good.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until the subscription has stopped for good.
+func (s *Subscription) Wait() {
+	<-s.done
+}
+
+// Close cancels the consumer, waits up to the grace period for deliveries
+// already received to be handled and then closes the channel, which returns
+// any unacknowledged messages to the queue.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closing = true
+		ch, tag := s.ch, s.tag
+		s.mu.Unlock()
+
+		if s.unregister != nil {
+			s.unregister()
+		}
+		if ch != nil {
+			ch.Cancel(tag, false)
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			s.consumers.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(s.opts.gracePeriod):
+			s.err = ErrDrainTimeout
+		}
+		if ch != nil {
+			ch.Close()
+		}
+		s.finish()
+	})
+	return s.err
+}
+
+// run declares and binds the subscription's queue and starts consuming it
+// until ctx is cancelled. A managed connection starts the consumer again
+// after every reconnect, with the same handler.
+func (s *Subscription) run(ctx context.Context, conn Connection, exchange, key string, queueOpts QueueOptions) error {
+	s.consume = func(conn Connection, tag string) (Channel, <-chan amqp.Delivery, error) {
+		ch, queue, err := DeclareAndBind(conn, exchange, s.queue, key, queueOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ch.Qos(s.opts.prefetch, 0, false)
+		if err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		msgs, err := ch.Consume(
+			queue.Name,
+			tag,
+			false,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		return ch, msgs, nil
+	}
+	return s.begin(ctx, conn)
+}
+
+// begin starts the consumer set up by run or runStream.
+func (s *Subscription) begin(ctx context.Context, conn Connection) error {
+	var err error
+	if mc, ok := conn.(*ManagedConnection); ok {
+		err = mc.addSubscription(s)
+	} else {
+		err = s.start(conn)
+	}
+	if err != nil {
+		return err
+	}
+	go s.watch(ctx)
+	return nil
+}
+
+func (s *Subscription) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.Close()
+	case <-s.done:
+	}
+}
+
+// start begins consuming on conn. It is called once when subscribing and
+// again after every reconnect of a managed connection.
+func (s *Subscription) start(conn Connection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	tag := fmt.Sprintf("peril-%s-%d", s.queue, consumerSeq.Add(1))
+	ch, msgs, err := s.consume(conn, tag)
+	if err != nil {
+		return err
+	}
+	s.ch = ch
+	s.tag = tag
+
+	resumable := s.unregister != nil
+	s.consumers.Add(1)
+	go func() {
+		defer s.consumers.Done()
+		// msgs is closed when the consumer is cancelled or the connection
+		// goes away.
+		s.process(ch, msgs)
+		if s.flush != nil {
+			s.flush()
+		}
+		if !resumable {
+			s.finish()
+		}
+	}()
+	return nil
+}
+
+// process hands deliveries to the subscription's workers and returns once
+// msgs is closed and every delivery has been handled. Each ordering key maps
+// to one worker, so deliveries with the same key are handled in order.
+// Deduplicating subscriptions without an ordering key are ordered by message
+// ID.
+func (s *Subscription) process(ch Channel, msgs <-chan amqp.Delivery) {
+	workers := s.opts.workers
+	if workers == 1 {
+		for msg := range msgs {
+			_, handle := s.prepare(ch, msg)
+			handle()
+		}
+		return
+	}
+
+	ordered := s.opts.orderingKey != nil || s.opts.dedup != nil
+	queues := make([]chan func(), 1)
+	if ordered {
+		queues = make([]chan func(), workers)
+	}
+	for i := range queues {
+		// The broker never sends more than prefetch unacked deliveries, so
+		// this much buffering keeps one busy key from stalling the others.
+		queues[i] = make(chan func(), s.opts.prefetch)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		jobs := queues[i%len(queues)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for handle := range jobs {
+				handle()
+			}
+		}()
+	}
+
+	for msg := range msgs {
+		key, handle := s.prepare(ch, msg)
+		shard := 0
+		if ordered {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			shard = int(h.Sum32() % uint32(len(queues)))
+		}
+		queues[shard] <- handle
+	}
+	for _, jobs := range queues {
+		close(jobs)
+	}
+	wg.Wait()
+}
+
+func (s *Subscription) finish() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWorkersRunInParallel holds every handler until all of them have
+// started, which only happens if the workers run at the same time.
+func TestWorkersRunInParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 4
+	var started sync.WaitGroup
+	started.Add(workers)
+	allStarted := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(allStarted)
+	}()
+	sub, err := Subscribe(ctx, conn, JSON, "peril_topic", "moves", "moves.*", DurableQueue,
+		func(string) AckType {
+			started.Done()
+			select {
+			case <-allStarted:
+				return Ack
+			case <-time.After(time.Second):
+				return NackDiscard
+			}
+		},
+		WithWorkers(workers),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for i := 0; i < workers; i++ {
+		if err := PublishJSON(ch, "peril_topic", "moves.alice", "move"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-allStarted:
+	case <-time.After(time.Second):
+		t.Fatalf("%d workers never all handled a delivery at once", workers)
+	}
+}
+
+// TestOrderingKey interleaves several players' moves and checks each
+// player's arrive in the order they were sent, however long each takes.
+func TestOrderingKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := dial(t, NewMemoryBroker())
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare("peril_topic", "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	type move struct {
+		Player string
+		Seq    int
+	}
+	players := []string{"alice", "bob", "carol", "dave"}
+	const moves = 20
+
+	var (
+		mu   sync.Mutex
+		seen = map[string][]int{}
+		done sync.WaitGroup
+	)
+	done.Add(len(players) * moves)
+	sub, err := Subscribe(ctx, conn, JSON, "peril_topic", "moves", "moves.*", DurableQueue,
+		func(m move) AckType {
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			mu.Lock()
+			seen[m.Player] = append(seen[m.Player], m.Seq)
+			mu.Unlock()
+			done.Done()
+			return Ack
+		},
+		WithWorkers(4),
+		WithPrefetch(len(players)*moves),
+		WithOrderingKey(func(m move) string { return m.Player }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for seq := 0; seq < moves; seq++ {
+		for _, p := range players {
+			if err := PublishJSON(ch, "peril_topic", "moves."+p, move{Player: p, Seq: seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not every move was handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range players {
+		want := make([]int, moves)
+		for i := range want {
+			want[i] = i
+		}
+		if got := fmt.Sprint(seen[p]); got != fmt.Sprint(want) {
+			t.Errorf("%s's moves were handled in the order %s", p, got)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology describes the exchanges, queues and bindings an application
+// expects the broker to have.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+	// Redeclare names queues an older version declared with other
+	// properties. RabbitMQ won't change a queue in place, so Migrate deletes
+	// and redeclares these when the broker refuses them, as long as they are
+	// empty.
+	Redeclare []string
+	// Obsolete names queues older versions declared that nothing uses any
+	// more. Migrate deletes them, and whatever they still hold.
+	Obsolete []string
+}
+
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+}
+
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	// DeadLetterExchange, if set, becomes the x-dead-letter-exchange argument.
+	DeadLetterExchange string
+	Args               amqp.Table
+}
+
+type BindingSpec struct {
+	Exchange string
+	Queue    string
+	Key      string
+}
+
+// TopologyInspector reports the topology a broker actually has.
+type TopologyInspector interface {
+	Topology() (Topology, error)
+}
+
+// Arguments returns the queue's declare arguments, including the dead-letter
+// exchange.
+func (q QueueSpec) Arguments() amqp.Table {
+	args := amqp.Table{}
+	for k, v := range q.Args {
+		args[k] = v
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	return args
+}
+
+// Apply declares everything in t. Declarations are idempotent, so it is safe
+// to run on every start; it fails if something exists with different
+// properties, which on a broker an older version set up calls for Migrate.
+func (t Topology) Apply(conn Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, ex := range t.Exchanges {
+		if err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, false, false, nil); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments()); err != nil {
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("bind queue %s to %s with %q: %w", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
+
+// Migrate brings a broker an older version set up into line with t and then
+// applies t. It replaces the queues t says to redeclare where the broker has
+// them with other properties, and deletes the obsolete queues with whatever
+// they still hold, so it is for an operator to run once when upgrading, not
+// for every start.
+func (t Topology) Migrate(conn Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer func() { ch.Close() }()
+
+	for _, q := range t.Queues {
+		if !slices.Contains(t.Redeclare, q.Name) {
+			continue
+		}
+		_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments())
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			// The broker closes the channel a declaration fails on.
+			ch.Close()
+			if ch, err = conn.Channel(); err != nil {
+				return err
+			}
+			err = redeclareQueue(ch, q)
+		}
+		if err != nil {
+			return fmt.Errorf("redeclare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, name := range t.Obsolete {
+		if _, err := ch.QueueDelete(name, false, false, false); err != nil {
+			return fmt.Errorf("delete obsolete queue %s: %w", name, err)
+		}
+	}
+	return t.Apply(conn)
+}
+
+// redeclareQueue replaces a queue an older version declared differently. It
+// refuses to delete one with messages left, which would be lost.
+func redeclareQueue(ch Channel, q QueueSpec) error {
+	if _, err := ch.QueueDelete(q.Name, false, true, false); err != nil {
+		return fmt.Errorf("replace the older version's queue, which must be drained or purged first: %w", err)
+	}
+	_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments())
+	return err
+}
+
+type DifferenceKind string
+
+const (
+	Missing    DifferenceKind = "missing"
+	Mismatched DifferenceKind = "differs"
+	Unexpected DifferenceKind = "unexpected"
+)
+
+type TopologyDifference struct {
+	Kind   DifferenceKind
+	Object string
+	Detail string
+}
+
+func (d TopologyDifference) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s %s", d.Kind, d.Object)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Object, d.Detail)
+}
+
+// Diff compares the live topology against the expected one. Broker-defined
+// exchanges, transient queues that clients create per session and retry
+// delay queues that expire on their own are not reported as unexpected.
+func Diff(want, live Topology) []TopologyDifference {
+	var diffs []TopologyDifference
+
+	liveExchanges := map[string]ExchangeSpec{}
+	for _, ex := range live.Exchanges {
+		liveExchanges[ex.Name] = ex
+	}
+	wantExchanges := map[string]bool{}
+	for _, ex := range want.Exchanges {
+		wantExchanges[ex.Name] = true
+		object := "exchange " + ex.Name
+		got, ok := liveExchanges[ex.Name]
+		if !ok {
+			diffs = append(diffs, TopologyDifference{Missing, object, fmt.Sprintf("%s, durable=%v", ex.Kind, ex.Durable)})
+			continue
+		}
+		diffs = append(diffs, compare(object, "type", got.Kind, ex.Kind)...)
+		diffs = append(diffs, compare(object, "durable", got.Durable, ex.Durable)...)
+		diffs = append(diffs, compare(object, "auto-delete", got.AutoDelete, ex.AutoDelete)...)
+	}
+	for _, ex := range live.Exchanges {
+		if !wantExchanges[ex.Name] && ex.Name != "" && !strings.HasPrefix(ex.Name, "amq.") {
+			diffs = append(diffs, TopologyDifference{Unexpected, "exchange " + ex.Name, ""})
+		}
+	}
+
+	liveQueues := map[string]QueueSpec{}
+	for _, q := range live.Queues {
+		liveQueues[q.Name] = q
+	}
+	wantQueues := map[string]bool{}
+	for _, q := range want.Queues {
+		wantQueues[q.Name] = true
+		object := "queue " + q.Name
+		got, ok := liveQueues[q.Name]
+		if !ok {
+			diffs = append(diffs, TopologyDifference{Missing, object, fmt.Sprintf("durable=%v", q.Durable)})
+			continue
+		}
+		diffs = append(diffs, compare(object, "durable", got.Durable, q.Durable)...)
+		diffs = append(diffs, compare(object, "auto-delete", got.AutoDelete, q.AutoDelete)...)
+		diffs = append(diffs, compare(object, "exclusive", got.Exclusive, q.Exclusive)...)
+		gotArgs, wantArgs := got.Arguments(), q.Arguments()
+		for _, k := range sortedKeys(wantArgs, gotArgs) {
+			diffs = append(diffs, compare(object, k, fmt.Sprint(gotArgs[k]), fmt.Sprint(wantArgs[k]))...)
+		}
+	}
+	for _, q := range live.Queues {
+		_, expires := q.Args["x-expires"]
+		if !wantQueues[q.Name] && q.Durable && !q.AutoDelete && !expires {
+			diffs = append(diffs, TopologyDifference{Unexpected, "queue " + q.Name, ""})
+		}
+	}
+
+	liveBindings := map[BindingSpec]bool{}
+	for _, b := range live.Bindings {
+		liveBindings[b] = true
+	}
+	wantBindings := map[BindingSpec]bool{}
+	for _, b := range want.Bindings {
+		wantBindings[b] = true
+		if !liveBindings[b] {
+			diffs = append(diffs, TopologyDifference{Missing, bindingObject(b), ""})
+		}
+	}
+	for _, b := range live.Bindings {
+		// Only bindings onto queues we manage are ours to judge.
+		if !wantBindings[b] && wantQueues[b.Queue] {
+			diffs = append(diffs, TopologyDifference{Unexpected, bindingObject(b), ""})
+		}
+	}
+	return diffs
+}
+
+func compare[T comparable](object, field string, got, want T) []TopologyDifference {
+	if got == want {
+		return nil
+	}
+	return []TopologyDifference{{Mismatched, object, fmt.Sprintf("%s is %v, want %v", field, got, want)}}
+}
+
+func bindingObject(b BindingSpec) string {
+	return fmt.Sprintf("binding %s -> %s (%q)", b.Exchange, b.Queue, b.Key)
+}
+
+func sortedKeys(tables ...amqp.Table) []string {
+	var keys []string
+	for _, t := range tables {
+		for k := range t {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Topology returns the broker's current exchanges, queues and bindings.
+func (b *MemoryBroker) Topology() (Topology, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var t Topology
+	for _, ex := range b.exchanges {
+		t.Exchanges = append(t.Exchanges, ExchangeSpec{
+			Name:       ex.name,
+			Kind:       ex.kind,
+			Durable:    ex.durable,
+			AutoDelete: ex.autoDelete,
+		})
+		if ex.name == "" {
+			continue
+		}
+		for _, binding := range ex.bindings {
+			t.Bindings = append(t.Bindings, BindingSpec{Exchange: ex.name, Queue: binding.queue.name, Key: binding.key})
+		}
+	}
+	for _, q := range b.queues {
+		t.Queues = append(t.Queues, QueueSpec{
+			Name:       q.name,
+			Durable:    q.durable,
+			AutoDelete: q.autoDelete,
+			Exclusive:  q.exclusive,
+			Args:       q.args,
+		})
+	}
+	return t, nil
+}
@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestMigrate migrates a broker an older version set up, with a queue since
+// declared differently and one nothing uses any more.
+func TestMigrate(t *testing.T) {
+	logs := QueueOptions{Type: QueueQuorum, Durable: true, MaxLength: 10, Overflow: OverflowRejectPublish}
+	topology := Topology{
+		Exchanges: []ExchangeSpec{{Name: "peril_topic", Kind: amqp.ExchangeTopic, Durable: true}},
+		Queues:    []QueueSpec{logs.Spec("game_logs")},
+		Bindings:  []BindingSpec{{Exchange: "peril_topic", Queue: "game_logs", Key: "game_logs.*"}},
+		Redeclare: []string{"game_logs"},
+		Obsolete:  []string{"war"},
+	}
+	old := func(t *testing.T, logsLeft bool) Connection {
+		t.Helper()
+		conn := dial(t, NewMemoryBroker())
+		ch := channel(t, conn)
+		if err := ch.ExchangeDeclare("peril_topic", amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{"game_logs", "war"} {
+			if _, err := ch.QueueDeclare(q, true, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.QueueBind(q, q+".*", "peril_topic", false, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if logsLeft {
+			if err := ch.PublishWithContext(context.Background(), "peril_topic", "game_logs.alice", false, false, amqp.Publishing{Body: []byte("hello")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return conn
+	}
+
+	t.Run("apply alone", func(t *testing.T) {
+		conn := old(t, false)
+		if err := topology.Apply(conn); err == nil {
+			t.Fatal("Apply accepted game_logs as the older version declared it")
+		}
+		ch := channel(t, conn)
+		if _, err := ch.QueueDeclare("game_logs", true, false, false, false, nil); err != nil {
+			t.Errorf("Apply replaced game_logs: %v", err)
+		}
+		if _, err := ch.QueueDeclare("war", true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.PublishWithContext(context.Background(), "peril_topic", "war.alice", false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := ch.Get("war", true); !ok {
+			t.Error("Apply deleted the obsolete war queue")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		conn := old(t, false)
+		if err := topology.Migrate(conn); err != nil {
+			t.Fatal(err)
+		}
+		ch := channel(t, conn)
+		if _, err := ch.QueueDeclare("game_logs", true, false, false, false, logs.Arguments()); err != nil {
+			t.Errorf("game_logs wasn't redeclared: %v", err)
+		}
+		if err := ch.PublishWithContext(context.Background(), "peril_topic", "war.alice", false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ch.QueueDeclare("war", true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := ch.Get("war", true); ok {
+			t.Error("the obsolete war queue is still bound")
+		}
+	})
+
+	t.Run("logs left", func(t *testing.T) {
+		conn := old(t, true)
+		if err := topology.Migrate(conn); err == nil {
+			t.Fatal("Migrate deleted a queue with messages left")
+		}
+		if d, ok, err := channel(t, conn).Get("game_logs", true); err != nil || !ok || string(d.Body) != "hello" {
+			t.Errorf("Get = %q, %v, %v, want the log left behind", d.Body, ok, err)
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	logs := QueueOptions{Type: QueueQuorum, Durable: true, MaxLength: 10, Overflow: OverflowRejectPublish}
+	want := Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "peril_topic", Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: "peril_direct", Kind: amqp.ExchangeDirect, Durable: true},
+		},
+		Queues: []QueueSpec{logs.Spec("game_logs"), {Name: "peril_dlq", Durable: true}},
+		Bindings: []BindingSpec{
+			{Exchange: "peril_topic", Queue: "game_logs", Key: "game_logs.*"},
+			{Exchange: "peril_topic", Queue: "peril_dlq", Key: "#"},
+		},
+	}
+	broker := NewMemoryBroker()
+	conn := dial(t, broker)
+	if err := want.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	live, err := broker.Topology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := Diff(want, live); len(diffs) != 0 {
+		t.Fatalf("freshly applied topology differs: %v", diffs)
+	}
+
+	// Drift from what is wanted in every way Diff looks for.
+	ch := channel(t, conn)
+	if err := ch.ExchangeDeclare("peril_old", amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []QueueSpec{
+		QueueOptions{Durable: true}.Spec("stray"),
+		// Per-player queues and retry delay queues come and go, so they
+		// aren't unexpected.
+		TransientQueue.Spec("pause.alice"),
+		{Name: "moves.retry.1000", Durable: true, Args: amqp.Table{"x-expires": int64(61000)}},
+	} {
+		if _, err := ch.QueueDeclare(spec.Name, spec.Durable, spec.AutoDelete, spec.Exclusive, false, spec.Arguments()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ch.QueueBind("game_logs", "war.*", "peril_topic", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	want.Exchanges = append(want.Exchanges, ExchangeSpec{Name: "peril_dlx", Kind: amqp.ExchangeFanout, Durable: true})
+	want.Queues[0] = QueueOptions{Type: QueueQuorum, Durable: true, MaxLength: 20, Overflow: OverflowRejectPublish}.Spec("game_logs")
+	want.Queues = append(want.Queues, QueueSpec{Name: "peril_events", Durable: true})
+	want.Bindings[1].Key = "dead.#"
+	want.Exchanges[1].Kind = amqp.ExchangeTopic
+
+	live, err = broker.Topology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range Diff(want, live) {
+		got = append(got, d.String())
+	}
+	slices.Sort(got)
+	wantDiffs := []string{
+		`differs exchange peril_direct: type is direct, want topic`,
+		`differs queue game_logs: x-max-length is 10, want 20`,
+		`missing binding peril_topic -> peril_dlq ("dead.#")`,
+		`missing exchange peril_dlx: fanout, durable=true`,
+		`missing queue peril_events: durable=true`,
+		`unexpected binding peril_topic -> game_logs ("war.*")`,
+		`unexpected binding peril_topic -> peril_dlq ("#")`,
+		`unexpected exchange peril_old`,
+		`unexpected queue stray`,
+	}
+	if !slices.Equal(got, wantDiffs) {
+		t.Errorf("got differences\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(wantDiffs, "\n  "))
+	}
+}
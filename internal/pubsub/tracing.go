@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Kobiee88/peril/internal/pubsub"
+
+// traceContext carries W3C trace context in message headers whatever
+// propagator the application has configured globally.
+var traceContext = propagation.TraceContext{}
+
+// headerCarrier adapts message headers to the OpenTelemetry propagation API.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startPublishSpan starts a producer span for a message and injects its
+// context into the message's headers, creating them if need be.
+func startPublishSpan(ctx context.Context, exchange, key string, msg *amqp.Publishing) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, publishSpanName(exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(key),
+		),
+	)
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	traceContext.Inject(ctx, headerCarrier(msg.Headers))
+	return ctx, span
+}
+
+// startConsumeSpan starts a consumer span for a delivery, as a child of the
+// span that published it if the publisher sent trace context.
+func startConsumeSpan(queue string, msg amqp.Delivery) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if msg.Headers != nil {
+		ctx = traceContext.Extract(ctx, headerCarrier(msg.Headers))
+	}
+	return otel.Tracer(tracerName).Start(ctx, queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(msg.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(msg.RoutingKey),
+			attribute.String("messaging.rabbitmq.queue", queue),
+		),
+	)
+}
+
+// startBatchSpan starts a consumer span for a batch of deliveries, linked to
+// the span that published each of them.
+func startBatchSpan(queue string, msgs []amqp.Delivery) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Headers == nil {
+			continue
+		}
+		ctx := traceContext.Extract(context.Background(), headerCarrier(msg.Headers))
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return otel.Tracer(tracerName).Start(context.Background(), queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingBatchMessageCount(len(msgs)),
+			attribute.String("messaging.rabbitmq.queue", queue),
+		),
+	)
+}
+
+// endSpan records the outcome of a publish or of handling a delivery.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func endConsumeSpan(span trace.Span, ackType AckType) {
+	span.SetAttributes(attribute.String("peril.ack", ackType.String()))
+	if ackType == NackDiscard {
+		span.SetStatus(codes.Error, "message discarded")
+	}
+	span.End()
+}
+
+func publishSpanName(exchange string) string {
+	if exchange == "" {
+		exchange = "(default)"
+	}
+	return fmt.Sprintf("%s publish", exchange)
+}
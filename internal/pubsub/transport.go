@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Connection is a connection to a message broker. It is satisfied by a
+// RabbitMQ connection returned from Dial and by connections to an in-process
+// MemoryBroker, so everything built on top of it can run without RabbitMQ.
+type Connection interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Publisher is anything messages can be published through: a Channel, or a
+// ManagedConnection that republishes on whichever connection is current.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Channel is the subset of the AMQP 0-9-1 channel operations used by Peril.
+// *amqp.Channel satisfies it directly. Messages, deliveries, queues and
+// tables reuse the amqp091 types so both transports speak the same language.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+type amqpConnection struct {
+	conn *amqp.Connection
+}
+
+// Dial connects to the RabbitMQ server at url.
+func Dial(url string) (Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &amqpConnection{conn: conn}, nil
+}
+
+func (c *amqpConnection) Channel() (Channel, error) {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (c *amqpConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return c.conn.NotifyClose(receiver)
+}
+
+func (c *amqpConnection) Close() error {
+	return c.conn.Close()
+}
@@ -1,16 +1,62 @@
 package routing
 
 const (
-	ArmyMovesPrefix = "army_moves"
+	// StateDeltaPrefix starts the routing keys of the changes the server
+	// makes to the world, followed by the name of the player whose intent
+	// caused them.
+	StateDeltaPrefix = "state"
 
-	WarRecognitionsPrefix = "war"
+	// WarResultPrefix starts the routing keys of war results, followed by
+	// the name of the belligerent each copy is for.
+	WarResultPrefix = "war"
 
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	DeadLetterQueue = "peril_dlq"
+
+	// GameEventStream records every change to the world and every pause so
+	// the game can be replayed from the beginning.
+	GameEventStream = "peril_game_events"
+
+	// GetPlayingStateKey routes requests for the current PlayingState to the
+	// server, which answers on the requester's reply queue.
+	GetPlayingStateKey = "rpc.get_playing_state"
+
+	// JoinKey, SpawnKey and MoveKey route players' intents to the server,
+	// which answers with a snapshot of the world or the change it made.
+	JoinKey  = "rpc.join"
+	SpawnKey = "rpc.spawn"
+	MoveKey  = "rpc.move"
+
+	// GetScenarioKey routes requests for the game's scenario to the server,
+	// so clients play on the map it loaded.
+	GetScenarioKey = "rpc.get_scenario"
+
+	// ScenarioEnv names the environment variable holding the scenario file
+	// the server loads. The built-in world is played when it is unset.
+	ScenarioEnv = "PERIL_SCENARIO"
+
+	// SaveFile is where the server saves the world after every change, and
+	// carries on from when it restarts.
+	SaveFile = "peril-save.json"
+
+	// ServerSender is the sender name the server stamps on its messages.
+	ServerSender = "server"
+
+	// KeystoreDir holds the server's and players' keys. Messages are only
+	// accepted from senders whose public keys are in it, so it is shared by
+	// everyone on one machine or its .pub files copied between machines.
+	KeystoreDir = "peril-keys"
+
+	// DirectKeyName names the shared key the server encrypts messages on the
+	// direct exchange with.
+	DirectKeyName = "peril_direct"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
 )
@@ -0,0 +1,49 @@
+package routing
+
+import (
+	"time"
+
+	"github.com/Kobiee88/peril/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// GameLogQueue is a quorum queue so it survives losing a broker node. It is
+// bounded, refusing new messages when full so publishers slow down rather
+// than the broker running out of memory.
+var GameLogQueue = pubsub.QueueOptions{
+	Type:               pubsub.QueueQuorum,
+	Durable:            true,
+	MaxLength:          10000,
+	Overflow:           pubsub.OverflowRejectPublish,
+	DeadLetterExchange: ExchangePerilDLX,
+}
+
+// Topology is everything Peril expects to exist on the broker before any
+// client joins. Per-player queues are declared by the clients themselves.
+// Only the server's migrate command replaces or deletes queues older
+// versions left behind.
+func Topology() pubsub.Topology {
+	return pubsub.Topology{
+		Exchanges: []pubsub.ExchangeSpec{
+			{Name: ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: ExchangePerilDLX, Kind: amqp.ExchangeFanout, Durable: true},
+		},
+		Queues: []pubsub.QueueSpec{
+			GameLogQueue.Spec(GameLogSlug),
+			{Name: DeadLetterQueue, Durable: true},
+			pubsub.StreamQueue(GameEventStream, 7*24*time.Hour),
+		},
+		Bindings: []pubsub.BindingSpec{
+			{Exchange: ExchangePerilTopic, Queue: GameLogSlug, Key: GameLogSlug + ".*"},
+			{Exchange: ExchangePerilDLX, Queue: DeadLetterQueue, Key: ""},
+			{Exchange: ExchangePerilTopic, Queue: GameEventStream, Key: StateDeltaPrefix + ".*"},
+			{Exchange: ExchangePerilDirect, Queue: GameEventStream, Key: PauseKey},
+		},
+		// Before game_logs was a bounded quorum queue it was a classic one.
+		Redeclare: []string{GameLogSlug},
+		// War recognitions used to be shared through the war queue, which
+		// would now collect a copy of every war result.
+		Obsolete: []string{WarResultPrefix},
+	}
+}
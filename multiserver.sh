@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# Starts several servers. The first to lock the saved game runs it; the
+# rest only help write the game logs.
+
 # Check if the number of instances was provided
 if [ -z "$1" ]; then
   echo "Usage: $0 <number-of-instances>"